@@ -20,12 +20,32 @@ func main() {
 	}
 
 	fmt.Println("Mini HTTP Started, Pressing CTRL + C to Shutdown")
+	static.NotifyReady()
 
 	sigChannel := make(chan os.Signal, 1)
-	signal.Notify(sigChannel, os.Interrupt, syscall.SIGTERM)
+	signals := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	if static.UpgradeSignal != nil {
+		signals = append(signals, static.UpgradeSignal)
+	}
+	signal.Notify(sigChannel, signals...)
 
-	<-sigChannel
+	for sig := range sigChannel {
+		if sig != static.UpgradeSignal {
+			break
+		}
+		if err := static.Upgrade(); err != nil {
+			fmt.Println("Mini HTTP Upgrade Failed:", err)
+		}
+	}
 	fmt.Println("")
+	// 等待正在处理的请求完成，再次收到信号时直接退出
+	go func() {
+		<-sigChannel
+		os.Exit(1)
+	}()
+	if err := static.Shutdown(); err != nil {
+		fmt.Println("Mini HTTP Shutdown:", err)
+	}
 	fmt.Println("Mini HTTP Closed")
 	os.Exit(0)
 }
@@ -42,12 +62,73 @@ func usage() {
 	flags := []flag{
 		{name: "port", description: "HTTP Port", defaultValue: "80", valueType: "int"},
 		{name: "https-port", description: "HTTPS Port", defaultValue: "0", valueType: "int"},
+		{name: "listen", description: "Listen on an address like 127.0.0.1:8080, [::1]:8443 or unix:/run/serve.sock, port 80 is not used unless --port is set", defaultValue: "", valueType: "string"},
+		{name: "listen-protocol", description: "Protocol of the last --listen: http, https or auto", defaultValue: "http", valueType: "string"},
+		{name: "trusted-proxies", description: "CIDRs of CDNs or proxies in front of the server, separated by commas", defaultValue: "", valueType: "string"},
+		{name: "real-ip-header", description: "Header with the client IP from trusted proxies: X-Forwarded-For, X-Real-IP, CF-Connecting-IP, Forwarded", defaultValue: "X-Forwarded-For", valueType: "string"},
+		{name: "listen-proxy-protocol", description: "Accept PROXY protocol v1/v2 on the last --listen from these CIDRs, separated by commas", defaultValue: "", valueType: "string"},
+		{name: "accept-proxy-protocol", description: "Accept PROXY protocol v1/v2 on --port and --https-port from these CIDRs", defaultValue: "", valueType: "string"},
+		{name: "listen-domain", description: "Only serve these domains on the last --listen, separated by commas", defaultValue: "", valueType: "string"},
+		{name: "http2", description: "Set 'off' to disable HTTP/2 on the HTTPS port", defaultValue: "on", valueType: "string"},
+		{name: "h2c", description: "Set 'on' to enable cleartext HTTP/2 on the HTTP port", defaultValue: "off", valueType: "string"},
+		{name: "http3", description: "Set 'on' to serve HTTP/3 on the UDP HTTPS port", defaultValue: "off", valueType: "string"},
+		{name: "http3-udp-buffer", description: "UDP read and write buffer size of HTTP/3, e.g. 8m", defaultValue: "", valueType: "size"},
 		{name: "root", description: "WWW Root", defaultValue: "/www/", valueType: "string"},
 		{name: "domain", description: "Domain", defaultValue: "", valueType: "string"},
+		{name: "alias", description: "Other host name of the domain, can be repeated", defaultValue: "", valueType: "string"},
 		{name: "cert", description: "Domain Cert File", defaultValue: "", valueType: "string"},
 		{name: "key", description: "Domain Key File", defaultValue: "", valueType: "string"},
+		{name: "force-https", description: "Redirect HTTP requests of the domain to HTTPS: on, 301, 308", defaultValue: "off", valueType: "string"},
+		{name: "hsts-max-age", description: "Send Strict-Transport-Security of the domain with max-age seconds", defaultValue: "0", valueType: "int"},
+		{name: "hsts-include-subdomains", description: "Set 'on' to add includeSubDomains to HSTS", defaultValue: "off", valueType: "string"},
+		{name: "hsts-preload", description: "Set 'on' to add preload to HSTS", defaultValue: "off", valueType: "string"},
+		{name: "ocsp-stapling", description: "Set 'off' to disable OCSP stapling of the domain cert", defaultValue: "on", valueType: "string"},
+		{name: "client-ca", description: "CA file to verify client certificates of the domain", defaultValue: "", valueType: "string"},
+		{name: "client-auth", description: "Client certificate mode of the domain: none, request, require, verify", defaultValue: "none", valueType: "string"},
+		{name: "tls-preset", description: "TLS preset of the domain: modern, intermediate", defaultValue: "", valueType: "string"},
+		{name: "tls-min-version", description: "Min TLS version of the domain, e.g. 1.2", defaultValue: "", valueType: "string"},
+		{name: "tls-max-version", description: "Max TLS version of the domain, e.g. 1.3", defaultValue: "", valueType: "string"},
+		{name: "tls-ciphers", description: "Comma separated TLS 1.2 cipher suites of the domain", defaultValue: "", valueType: "string"},
+		{name: "tls-curves", description: "Comma separated curves of the domain, e.g. X25519,P-256", defaultValue: "", valueType: "string"},
+		{name: "ca-dir", description: "Directory of the self-signed root CA and issued certificates", defaultValue: "", valueType: "string"},
+		{name: "ca-cert", description: "Use an existing root or intermediate CA cert to issue certificates", defaultValue: "", valueType: "string"},
+		{name: "ca-key", description: "Private key of --ca-cert", defaultValue: "", valueType: "string"},
+		{name: "ca-subject", description: "Subject of the generated root CA", defaultValue: "CN=IKrong Root CA,O=IKrong Root CA", valueType: "string"},
+		{name: "read-header-timeout", description: "Time allowed to read request headers, also limits the protocol detection on the https port", defaultValue: "10s", valueType: "duration"},
+		{name: "read-timeout", description: "Time allowed to read the whole request, 0 for no limit", defaultValue: "0", valueType: "duration"},
+		{name: "write-timeout", description: "Time allowed to write the response, 0 for no limit, websocket and SSE are not limited", defaultValue: "0", valueType: "duration"},
+		{name: "idle-timeout", description: "How long to keep idle keep-alive connections", defaultValue: "2m", valueType: "duration"},
+		{name: "max-header-bytes", description: "Max size of request headers, e.g. 64k", defaultValue: "1m", valueType: "size"},
+		{name: "max-connections", description: "Max concurrent connections of all listeners, 0 for no limit", defaultValue: "0", valueType: "int"},
+		{name: "shutdown-timeout", description: "How long to wait for running requests on shutdown or upgrade", defaultValue: "30s", valueType: "duration"},
+		{name: "cert-reload-interval", description: "Interval to check cert and key files for changes, 0 to disable", defaultValue: "1m", valueType: "duration"},
+		{name: "acme", description: "Set 'on' to issue certificate of the domain by ACME", defaultValue: "off", valueType: "string"},
+		{name: "acme-email", description: "ACME account email", defaultValue: "", valueType: "string"},
+		{name: "acme-directory", description: "ACME directory url", defaultValue: "https://acme-v02.api.letsencrypt.org/directory", valueType: "string"},
+		{name: "acme-dir", description: "Directory to store ACME account and certificates", defaultValue: "", valueType: "string"},
+		{name: "acme-ca", description: "Root CA file to trust the ACME server, e.g. Pebble", defaultValue: "", valueType: "string"},
 		{name: "mode", description: "Set 'history' enable Single Page Routing", defaultValue: "", valueType: "string"},
-		{name: "proxy", description: "Set proxy api", defaultValue: "", valueType: "string"},
+		{name: "proxy", description: "Set proxy api, e.g. /api:http://host, /api:unix:///run/app.sock, /rpc:h2c://host:port, /php:fastcgi://host:9000", defaultValue: "", valueType: "string"},
+		{name: "ws-handshake-timeout", description: "WebSocket handshake timeout of the last proxy", defaultValue: "10s", valueType: "duration"},
+		{name: "ws-idle-timeout", description: "WebSocket idle timeout of the last proxy, negative to disable", defaultValue: "5m", valueType: "duration"},
+		{name: "proxy-buffering", description: "Set 'off' to flush every write of the last proxy", defaultValue: "on", valueType: "string"},
+		{name: "proxy-max-body", description: "Max request body size of the last proxy, e.g. 10m", defaultValue: "", valueType: "size"},
+		{name: "proxy-cache", description: "Enable response cache of the last proxy with max size, e.g. 64m", defaultValue: "", valueType: "size"},
+		{name: "proxy-cache-dir", description: "Store response cache of the last proxy on disk", defaultValue: "", valueType: "string"},
+		{name: "proxy-mirror", description: "Copy requests of the last proxy to another upstream", defaultValue: "", valueType: "string"},
+		{name: "proxy-mirror-percent", description: "Percentage of requests to mirror", defaultValue: "100", valueType: "float"},
+		{name: "proxy-mirror-timeout", description: "Timeout of mirrored requests", defaultValue: "5s", valueType: "duration"},
+		{name: "proxy-mirror-max-body", description: "Max body size of mirrored requests", defaultValue: "1m", valueType: "size"},
+		{name: "proxy-fallback", description: "Fallback of the last proxy when upstream fails: static, json:{...} or /file.html", defaultValue: "", valueType: "string"},
+		{name: "proxy-fallback-code", description: "Status code of json or file fallback", defaultValue: "503", valueType: "int"},
+		{name: "proxy-fallback-on", description: "Upstream status codes that trigger fallback, e.g. 502,503,504", defaultValue: "", valueType: "string"},
+		{name: "proxy-record", description: "Record traffic of the last proxy to a HAR file", defaultValue: "", valueType: "string"},
+		{name: "proxy-record-redact", description: "Headers redacted in the HAR file", defaultValue: "Authorization,Cookie,Set-Cookie,Proxy-Authorization", valueType: "string"},
+		{name: "proxy-replay", description: "Replay responses of the last proxy from a HAR file", defaultValue: "", valueType: "string"},
+		{name: "proxy-replay-match-body", description: "Set 'on' to match request body when replaying", defaultValue: "off", valueType: "string"},
+		{name: "cache-purge", description: "Path of the cache purge endpoint, e.g. /_purge", defaultValue: "", valueType: "string"},
+		{name: "mock", description: "Answer requests with files, e.g. /api:./mocks serves mocks/GET/users/{id}.json", defaultValue: "", valueType: "string"},
+		{name: "mock-delay", description: "Artificial latency of the last mock", defaultValue: "", valueType: "duration"},
 		{name: "not-found", description: "Custom 404 page", defaultValue: "/404.html", valueType: "string"},
 	}
 	for i := 0; i < len(flags); i++ {
@@ -65,6 +146,8 @@ func usage() {
 			f.description,
 		)
 	}
+	fmt.Printf("\nManage the self-signed root CA with: %s ca path|export|rotate|inspect|issue <domain>\n", name)
+	fmt.Printf("Send SIGUSR2 to upgrade %s without refusing connections, SIGTERM to shut down gracefully\n", name)
 }
 
 func checkArgs() {
@@ -74,6 +157,14 @@ func checkArgs() {
 			os.Exit(0)
 		}
 
+		if i == 1 && os.Args[i] == "ca" {
+			if err := static.RunCA(os.Args[i+1:], os.Stdout); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			os.Exit(0)
+		}
+
 		if os.Args[i] == "get" {
 			url := os.Args[i+1]
 			_, status, err := static.Get(url)
@@ -1,18 +1,40 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"io"
+	"math/big"
 	"mini-http/static"
+	"net"
 	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/quic-go/quic-go/http3"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ocsp"
 )
 
 var port = 32000
@@ -297,6 +319,2135 @@ func Test(t *testing.T) {
 	}
 }
 
+func TestWebSocketProxy(t *testing.T) {
+	// 模拟 websocket 后端：握手成功后原样回显
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("upgrade") != "websocket" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Protocol: %s\r\nX-Path: %s\r\n\r\n",
+			r.Header.Get("Sec-WebSocket-Protocol"), r.URL.RequestURI())
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+
+	port++
+	httpPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/ws:" + strings.Replace(backend.URL, "http", "ws", 1) + "/socket?token=1",
+		"--ws-idle-timeout", "200ms",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /ws/chat?room=a HTTP/1.1\r\nHost: localhost\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Protocol: chat\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	assert.Equal(t, "chat", response.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Equal(t, "/socket/chat?token=1&room=a", response.Header.Get("X-Path"))
+
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(reader, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// 空闲超时后代理应关闭连接
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = reader.ReadByte()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestStreamingProxy(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			_, err := io.Copy(io.Discard, r.Body)
+			if err != nil {
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("content-type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		fmt.Fprint(w, "data: second\n\n")
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	port++
+	httpPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-max-body", "1k",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.Get(fmt.Sprintf("http://localhost:%d/api/events", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	// 后端还没结束响应，第一条事件就应该到达客户端
+	line, err := bufio.NewReader(response.Body).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "data: first\n", line)
+
+	url := fmt.Sprintf("http://localhost:%d/api/upload", httpPort)
+	response, err = http.Post(url, "text/plain", strings.NewReader(strings.Repeat("a", 512)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusNoContent, response.StatusCode)
+	}
+	response, err = http.Post(url, "text/plain", strings.NewReader(strings.Repeat("a", 2048)))
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	}
+	// 分块上传时无法预先知道大小，超出限制同样返回 413
+	response, err = http.Post(url, "text/plain", io.MultiReader(strings.NewReader(strings.Repeat("a", 2048))))
+	if assert.Nil(t, err) {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, response.StatusCode)
+	}
+}
+
+func TestUnixAndH2CProxy(t *testing.T) {
+	socket := path.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unixBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "unix %s %s", r.Host, r.URL.RequestURI())
+	}))
+	unixBackend.Listener = ln
+	unixBackend.Start()
+	defer unixBackend.Close()
+
+	// 模拟 gRPC 后端：只接受 HTTP/2 明文连接，并返回 trailer
+	h2cBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/grpc")
+		w.Header().Set("trailer", "grpc-status")
+		fmt.Fprintf(w, "HTTP/%d", r.ProtoMajor)
+		w.Header().Set("grpc-status", "0")
+	}))
+	h2cBackend.Config.Protocols = new(http.Protocols)
+	h2cBackend.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2cBackend.Start()
+	defer h2cBackend.Close()
+
+	port++
+	httpPort := port
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/unix:unix://" + socket,
+		"--proxy", "/grpc:" + strings.Replace(h2cBackend.URL, "http", "h2c", 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, status, err := get(fmt.Sprintf("http://localhost:%d/unix/users?id=1", httpPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, fmt.Sprintf("unix localhost:%d /users?id=1", httpPort), content)
+
+	response, err := http.Post(fmt.Sprintf("http://localhost:%d/grpc/Service/Method", httpPort), "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	assert.Equal(t, "HTTP/2", string(body))
+	assert.Equal(t, "0", response.Trailer.Get("grpc-status"))
+}
+
+func TestFastCGIProxy(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// 用 net/http/fcgi 模拟 php-fpm
+	go fcgi.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		env := fcgi.ProcessEnv(r)
+		if r.URL.Query().Get("early") != "" {
+			// 不读取请求体直接返回
+			fmt.Fprint(w, "early")
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Query().Get("redirect") != "" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.Header().Set("X-Script", env["SCRIPT_FILENAME"])
+		w.Header().Set("X-Path-Translated", env["PATH_TRANSLATED"])
+		w.Header().Set("X-Content-Length", strconv.FormatInt(r.ContentLength, 10))
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RawQuery, body)
+	}))
+
+	root := fmt.Sprintf("%s/assets/domain/localhost", currentDir)
+	port++
+	httpPort := port
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", root,
+		"--proxy", "/legacy:fastcgi://" + ln.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.Post(
+		fmt.Sprintf("http://localhost:%d/legacy/index.php/users/1?page=2", httpPort),
+		"application/x-www-form-urlencoded",
+		strings.NewReader("name=mini"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, root+"/legacy/index.php", response.Header.Get("X-Script"))
+	assert.Equal(t, root+"/users/1", response.Header.Get("X-Path-Translated"))
+	assert.Equal(t, "POST page=2 name=mini", string(body))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err = client.Get(fmt.Sprintf("http://localhost:%d/legacy/?redirect=1", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusFound, response.StatusCode)
+	assert.Equal(t, "/login", response.Header.Get("Location"))
+
+	// chunked 请求体也需要传递 CONTENT_LENGTH
+	response, err = http.Post(
+		fmt.Sprintf("http://localhost:%d/legacy/index.php", httpPort),
+		"text/plain",
+		io.MultiReader(strings.NewReader("chunked "), strings.NewReader("body")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, "12", response.Header.Get("X-Content-Length"))
+	assert.Equal(t, "POST  chunked body", string(body))
+
+	// php 没有读取请求体就返回时，等请求体读取结束后再完成请求
+	reader, writer := io.Pipe()
+	req, _ := http.NewRequest("POST", fmt.Sprintf("http://localhost:%d/legacy/index.php?early=1", httpPort), reader)
+	// 超过 net/http 在返回响应前会丢弃的请求体大小
+	req.ContentLength = 300 << 10
+	done := make(chan string, 1)
+	go func() {
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		done <- string(body)
+	}()
+	writer.Write([]byte("hello"))
+	select {
+	case <-done:
+		t.Error("request finished before the body was sent")
+	case <-time.After(200 * time.Millisecond):
+	}
+	go func() {
+		writer.Write(make([]byte, 300<<10-5))
+		writer.Close()
+	}()
+	select {
+	case body := <-done:
+		assert.Equal(t, "early", body)
+	case <-time.After(2 * time.Second):
+		t.Error("request not finished")
+	}
+
+	// 不能执行 Root 以外的脚本
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /legacy/../../../tmp/x.php HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	response, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, response.StatusCode)
+}
+
+func TestProxyCache(t *testing.T) {
+	var count atomic.Int32
+	var broken bool
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// 后台验证和客户端请求可能同时到达
+		hits := count.Add(1)
+		switch r.URL.Path {
+		case "/fresh":
+			w.Header().Set("cache-control", "max-age=60")
+			fmt.Fprintf(w, "fresh %d", hits)
+		case "/etag":
+			w.Header().Set("cache-control", "no-cache")
+			w.Header().Set("etag", `"v1"`)
+			if r.Header.Get("if-none-match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			fmt.Fprintf(w, "etag %d", hits)
+		case "/vary":
+			w.Header().Set("cache-control", "max-age=60")
+			w.Header().Set("vary", "accept-language")
+			fmt.Fprintf(w, "%s %d", r.Header.Get("accept-language"), hits)
+		case "/unstable":
+			if broken {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("cache-control", "max-age=0, stale-if-error=60")
+			fmt.Fprintf(w, "unstable %d", hits)
+		case "/large":
+			// 没有 Content-Length，读到超过缓存上限时才知道不能缓存
+			w.Header().Set("cache-control", "max-age=60")
+			for i := 0; i < 8; i++ {
+				if i == 5 {
+					<-release
+				}
+				w.Write(bytes.Repeat([]byte("a"), 64<<10))
+				w.(http.Flusher).Flush()
+			}
+		case "/revive":
+			// 后台验证比客户端请求结束得晚
+			time.Sleep(50 * time.Millisecond)
+			w.Header().Set("cache-control", "max-age=0, stale-while-revalidate=60")
+			fmt.Fprintf(w, "revive %d", hits)
+		}
+	}))
+	defer backend.Close()
+
+	port++
+	httpPort := port
+	cacheDir := t.TempDir()
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--cache-purge", "/_purge",
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-cache", "1m",
+		"--proxy-cache-dir", cacheDir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(method string, path string, header ...string) (string, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", httpPort, path), nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.Header.Get("X-Cache"), string(body)
+	}
+
+	status, body := request("GET", "/api/fresh")
+	assert.Equal(t, "MISS", status)
+	assert.Equal(t, "fresh 1", body)
+	status, body = request("GET", "/api/fresh")
+	assert.Equal(t, "HIT", status)
+	assert.Equal(t, "fresh 1", body)
+
+	request("GET", "/api/etag")
+	status, body = request("GET", "/api/etag")
+	assert.Equal(t, "REVALIDATED", status)
+	assert.Equal(t, "etag 2", body)
+
+	_, body = request("GET", "/api/vary", "accept-language", "zh")
+	assert.Equal(t, "zh 4", body)
+	_, body = request("GET", "/api/vary", "accept-language", "en")
+	assert.Equal(t, "en 5", body)
+	status, body = request("GET", "/api/vary", "accept-language", "zh")
+	assert.Equal(t, "HIT", status)
+	assert.Equal(t, "zh 4", body)
+
+	request("GET", "/api/unstable")
+	broken = true
+	status, body = request("GET", "/api/unstable")
+	assert.Equal(t, "STALE", status)
+	assert.Equal(t, "unstable 6", body)
+
+	// 超过缓存上限的响应不缓存，也不会留下写了一半的文件
+	files, _ := filepath.Glob(path.Join(cacheDir, "*.cache"))
+	response, err := http.Get(fmt.Sprintf("http://localhost:%d/api/large", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 响应还没结束，已经写入的内容就要释放
+	io.ReadFull(response.Body, make([]byte, 320<<10))
+	partial, _ := filepath.Glob(path.Join(cacheDir, "*.cache"))
+	assert.Equal(t, len(files), len(partial))
+	close(release)
+	rest, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, 192<<10, len(rest))
+	status, _ = request("GET", "/api/large")
+	assert.Equal(t, "MISS", status)
+	after, _ := filepath.Glob(path.Join(cacheDir, "*.cache"))
+	assert.Equal(t, len(files), len(after))
+
+	_, stale := request("GET", "/api/revive")
+	status, body = request("GET", "/api/revive")
+	assert.Equal(t, "STALE", status)
+	assert.Equal(t, stale, body)
+	// 客户端请求结束后，后台验证仍然会更新缓存
+	assert.Eventually(t, func() bool {
+		_, body = request("GET", "/api/revive")
+		return body != stale
+	}, 2*time.Second, 100*time.Millisecond)
+
+	_, body = request("POST", "/_purge?path=/api/fresh")
+	assert.Equal(t, "{\"purged\":1}\n", body)
+	status, _ = request("GET", "/api/fresh")
+	assert.Equal(t, "MISS", status)
+}
+
+func TestProxyMirror(t *testing.T) {
+	mirrored := make(chan string, 10)
+	mirror := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mirrored <- fmt.Sprintf("%s %s %s", r.Method, r.URL.RequestURI(), body)
+		// 镜像后端很慢也不能影响主请求
+		time.Sleep(time.Second)
+	}))
+	defer mirror.Close()
+	received := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			// 收到第一部分请求体后通知客户端继续发送
+			first := make([]byte, 5)
+			io.ReadFull(r.Body, first)
+			received <- struct{}{}
+			rest, _ := io.ReadAll(r.Body)
+			fmt.Fprintf(w, "primary %s%s", first, rest)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "primary %s", body)
+	}))
+	defer backend.Close()
+
+	port++
+	httpPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-mirror", mirror.URL + "/v2",
+		"--proxy-mirror-timeout", "100ms",
+		"--proxy-mirror-max-body", "16",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := fmt.Sprintf("http://localhost:%d/api/users?id=1", httpPort)
+	start := time.Now()
+	response, err := http.Post(url, "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, "primary hello", string(body))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	select {
+	case m := <-mirrored:
+		assert.Equal(t, "POST /v2/users?id=1 hello", m)
+	case <-time.After(time.Second):
+		t.Error("request not mirrored")
+	}
+
+	// 请求体边发送给主后端边复制，不需要等请求体全部到达
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("hello"))
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+		}
+		writer.Write([]byte(" world"))
+		writer.Close()
+	}()
+	start = time.Now()
+	response, err = http.Post(fmt.Sprintf("http://localhost:%d/api/upload", httpPort), "text/plain", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, "primary hello world", string(body))
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+	select {
+	case m := <-mirrored:
+		assert.Equal(t, "POST /v2/upload hello world", m)
+	case <-time.After(time.Second):
+		t.Error("request not mirrored")
+	}
+
+	// 超过缓存上限的请求体不镜像，但主请求不受影响
+	response, err = http.Post(url, "text/plain", strings.NewReader(strings.Repeat("a", 32)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, "primary "+strings.Repeat("a", 32), string(body))
+	select {
+	case m := <-mirrored:
+		t.Errorf("unexpected mirrored request %s", m)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestProxyFallback(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(path.Join(root, "maintenance.html"), []byte("maintenance"), 0644)
+	os.MkdirAll(path.Join(root, "busy"), 0755)
+	os.WriteFile(path.Join(root, "busy", "index.html"), []byte("static busy"), 0644)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer backend.Close()
+	// 关闭后的地址用来模拟不可用的后端
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	port++
+	httpPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", root,
+		"--proxy", "/down:" + down.URL,
+		"--proxy-fallback", "/maintenance.html",
+		"--proxy", "/json:" + down.URL,
+		"--proxy-fallback", `json:{"message":"unavailable"}`,
+		"--proxy-fallback-code", "502",
+		"--proxy", "/busy:" + backend.URL,
+		"--proxy-fallback", "static",
+		"--proxy-fallback-on", "502,503",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, status, err := get(fmt.Sprintf("http://localhost:%d/down/users", httpPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "maintenance", content)
+
+	content, status, err = get(fmt.Sprintf("http://localhost:%d/json/users", httpPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusBadGateway, status)
+	assert.Equal(t, `{"message":"unavailable"}`, content)
+
+	content, status, err = get(fmt.Sprintf("http://localhost:%d/busy/", httpPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "static busy", content)
+}
+
+func TestMock(t *testing.T) {
+	mocks := path.Join(t.TempDir(), "mocks")
+	os.WriteFile(path.Join(mocks, "..", "secret.json"), []byte(`{"secret":true}`), 0644)
+	os.MkdirAll(path.Join(mocks, "GET", "users"), 0755)
+	os.MkdirAll(path.Join(mocks, "POST"), 0755)
+	os.WriteFile(path.Join(mocks, "GET", "users", "{id}.json"), []byte(`{"id":"{{id}}"}`), 0644)
+	os.WriteFile(path.Join(mocks, "GET", "users", "me.json"), []byte(`{"id":"me"}`), 0644)
+	os.WriteFile(path.Join(mocks, "POST", "users.json"), []byte(`{"created":true}`), 0644)
+	os.WriteFile(path.Join(mocks, "POST", "users.meta.json"), []byte(`{"status":201,"headers":{"X-Mock":"1"},"delay":"50ms"}`), 0644)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "backend %s", r.URL.Path)
+	}))
+	defer backend.Close()
+
+	port++
+	httpPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--mock", "/api:" + mocks,
+		"--proxy", "/api:" + backend.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, status, err := get(fmt.Sprintf("http://localhost:%d/api/users/42", httpPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"id":"42"}`, content)
+
+	content, _, _ = get(fmt.Sprintf("http://localhost:%d/api/users/me", httpPort), "")
+	assert.Equal(t, `{"id":"me"}`, content)
+
+	start := time.Now()
+	response, err := http.Post(fmt.Sprintf("http://localhost:%d/api/users", httpPort), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusCreated, response.StatusCode)
+	assert.Equal(t, "1", response.Header.Get("X-Mock"))
+	assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// 没有对应的 mock 文件，交给代理处理
+	content, _, _ = get(fmt.Sprintf("http://localhost:%d/api/orders", httpPort), "")
+	assert.Equal(t, "backend /orders", content)
+
+	// 方法名不能用来读取 mock 目录之外的文件
+	req, _ := http.NewRequest("..", fmt.Sprintf("http://localhost:%d/api/secret", httpPort), nil)
+	response, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err) {
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, "backend /secret", string(body))
+	}
+}
+
+func TestProxyRecordAndReplay(t *testing.T) {
+	har := path.Join(t.TempDir(), "traffic.har")
+	received := make(chan struct{}, 1)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/upload" {
+			// 收到第一部分请求体后通知客户端继续上传
+			first := make([]byte, 5)
+			io.ReadFull(r.Body, first)
+			received <- struct{}{}
+			n, _ := io.Copy(io.Discard, r.Body)
+			fmt.Fprintf(w, "%s %d", first, n)
+			return
+		}
+		if r.URL.Path == "/events" {
+			// 一直不结束的 SSE，录制时也要立即转发
+			w.Header().Set("content-type", "text/event-stream")
+			fmt.Fprint(w, "data: first\n\n")
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("set-cookie", "session=secret")
+		fmt.Fprintf(w, "%s %s %s", r.Method, r.URL.RequestURI(), body)
+	}))
+
+	port++
+	recordPort := port
+	port++
+	replayPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", recordPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-record", har,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _, err := get(fmt.Sprintf("http://localhost:%d/api/users?b=2&a=1", recordPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, "GET /users?b=2&a=1 ", content)
+	response, err := http.Post(fmt.Sprintf("http://localhost:%d/api/users", recordPort), "text/plain", strings.NewReader("one"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	client := http.Client{Timeout: 2 * time.Second}
+	response, err = client.Get(fmt.Sprintf("http://localhost:%d/api/events", recordPort))
+	if assert.Nil(t, err) {
+		line, _ := bufio.NewReader(response.Body).ReadString('\n')
+		assert.Equal(t, "data: first\n", line)
+		response.Body.Close()
+	}
+
+	// 上传的请求体边转发边记录，超过上限的部分不写入文件
+	reader, writer := io.Pipe()
+	go func() {
+		writer.Write([]byte("hello"))
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+		}
+		writer.Write(bytes.Repeat([]byte("a"), 3<<20/2))
+		writer.Close()
+	}()
+	response, err = client.Post(fmt.Sprintf("http://localhost:%d/api/upload", recordPort), "text/plain", reader)
+	if assert.Nil(t, err) {
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, fmt.Sprintf("hello %d", 3<<20/2), string(body))
+	}
+
+	// 每条记录追加到文件中，文件始终是完整的 HAR
+	entries := func(count int) []byte {
+		var recorded []byte
+		assert.Eventually(t, func() bool {
+			var parsed struct {
+				Log struct{ Entries []json.RawMessage }
+			}
+			recorded, _ = os.ReadFile(har)
+			return json.Unmarshal(recorded, &parsed) == nil && len(parsed.Log.Entries) == count
+		}, time.Second, 10*time.Millisecond)
+		return recorded
+	}
+	recorded := entries(4)
+	assert.Contains(t, string(recorded), `"version": "1.2"`)
+	assert.NotContains(t, string(recorded), "session=secret")
+	assert.Contains(t, string(recorded), fmt.Sprintf(`"comment": "truncated to %d of %d bytes"`, 1<<20, 3<<20/2+5))
+	assert.Less(t, len(recorded), 2<<20)
+
+	// 重新启动时继续追加到已有的记录
+	port++
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", port),
+		"--domain", "localhost",
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-record", har,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = get(fmt.Sprintf("http://localhost:%d/api/again", port), "")
+	assert.Nil(t, err)
+	entries(5)
+
+	// 不是 HAR 的文件不会被覆盖
+	other := path.Join(t.TempDir(), "notes.txt")
+	os.WriteFile(other, []byte("notes"), 0644)
+	port++
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", port),
+		"--domain", "localhost",
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-record", other,
+	})
+	assert.NotNil(t, err)
+	notes, _ := os.ReadFile(other)
+	assert.Equal(t, "notes", string(notes))
+
+	// 回放文件不存在时启动失败
+	port++
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", port),
+		"--domain", "localhost",
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-replay", path.Join(t.TempDir(), "missing.har"),
+	})
+	assert.NotNil(t, err)
+
+	// 回放时后端已经停止
+	backend.Close()
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", replayPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/api:" + backend.URL,
+		"--proxy-replay", har,
+		"--proxy-replay-match-body", "on",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, status, err := get(fmt.Sprintf("http://localhost:%d/api/users?a=1&b=2", replayPort), "")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "GET /users?b=2&a=1 ", content)
+
+	url := fmt.Sprintf("http://localhost:%d/api/users", replayPort)
+	response, err = http.Post(url, "text/plain", strings.NewReader("one"))
+	if assert.Nil(t, err) {
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, "POST /users one", string(body))
+	}
+	response, err = http.Post(url, "text/plain", strings.NewReader("two"))
+	if assert.Nil(t, err) {
+		response.Body.Close()
+		assert.Equal(t, http.StatusNotFound, response.StatusCode)
+	}
+}
+
+func TestACME(t *testing.T) {
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	args := []string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--acme-dir", t.TempDir(),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--acme", "on",
+	}
+	// 设置 PEBBLE_DIRECTORY 和 PEBBLE_CA 后，会向本地的 Pebble 申请证书
+	directory, pebbleCA := os.Getenv("PEBBLE_DIRECTORY"), os.Getenv("PEBBLE_CA")
+	if directory != "" {
+		args = append(args, "--acme-directory", directory, "--acme-ca", pebbleCA)
+	} else {
+		args = append(args, "--acme-directory", "https://127.0.0.1:1/dir")
+	}
+	err := static.RunServer(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err := client.Get(fmt.Sprintf("http://localhost:%d/a?b=1", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusMovedPermanently, response.StatusCode)
+	assert.Equal(t, fmt.Sprintf("https://localhost:%d/a?b=1", httpsPort), response.Header.Get("Location"))
+
+	// 不存在的验证请求不会被重定向
+	response, err = client.Get(fmt.Sprintf("http://localhost:%d/.well-known/acme-challenge/unknown", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	if directory == "" {
+		t.Skip("PEBBLE_DIRECTORY not set, skip issuing certificate")
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	response, err = (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://localhost:%d", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Contains(t, response.TLS.PeerCertificates[0].Issuer.CommonName, "Pebble")
+}
+
+// 生成证书，parent 为空时自签名
+func createTestCertificate(t *testing.T, template *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(24 * time.Hour)
+	}
+	issuer, issuerKey := template, any(key)
+	if parent != nil {
+		issuer, issuerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func writeTestCertificateFiles(t *testing.T, cert tls.Certificate, certFile string, keyFile string) {
+	keyDer, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certPEM []byte
+	for _, der := range cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	os.WriteFile(certFile, certPEM, 0644)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+}
+
+// 生成自签名证书写入 dir/cert.pem 和 dir/key.pem
+func writeTestCertificate(t *testing.T, dir string, serial int64, notAfter time.Time) {
+	cert := createTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotAfter:     notAfter,
+	}, nil)
+	writeTestCertificateFiles(t, cert, path.Join(dir, "cert.pem"), path.Join(dir, "key.pem"))
+	// 保证修改时间发生变化
+	modTime := time.Now().Add(time.Duration(serial) * time.Second)
+	os.Chtimes(path.Join(dir, "cert.pem"), modTime, modTime)
+	os.Chtimes(path.Join(dir, "key.pem"), modTime, modTime)
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCertificate(t, dir, 1, time.Now().Add(24*time.Hour))
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--cert-reload-interval", "50ms",
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--cert", path.Join(dir, "cert.pem"),
+		"--key", path.Join(dir, "key.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", httpsPort), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	assert.Equal(t, int64(1), serial())
+
+	writeTestCertificate(t, dir, 2, time.Now().Add(24*time.Hour))
+	assert.Eventually(t, func() bool { return serial() == 2 }, 2*time.Second, 50*time.Millisecond)
+
+	// 过期或者不匹配的证书不会替换当前证书
+	writeTestCertificate(t, dir, 3, time.Now().Add(-time.Minute))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int64(2), serial())
+
+	certContent, _ := os.ReadFile(path.Join(dir, "cert.pem"))
+	writeTestCertificate(t, dir, 4, time.Now().Add(24*time.Hour))
+	os.WriteFile(path.Join(dir, "cert.pem"), certContent, 0644)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, int64(2), serial())
+
+	// 服务关闭后不再检查证书文件
+	assert.Nil(t, static.Shutdown())
+	assert.Eventually(t, func() bool {
+		stack := make([]byte, 1<<20)
+		stack = stack[:runtime.Stack(stack, true)]
+		return !strings.Contains(string(stack), "newCertReloader") && !strings.Contains(string(stack), "stapleOCSP")
+	}, time.Second, 50*time.Millisecond)
+}
+
+func TestClientCertificateAuth(t *testing.T) {
+	dir := t.TempDir()
+	clientCA := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Client CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	os.WriteFile(path.Join(dir, "client_ca.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCA.Certificate[0]}), 0644)
+	clientCert := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "alice", Organization: []string{"ops"}},
+		EmailAddresses: []string{"alice@example.com"},
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &clientCA)
+	otherCert := createTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "mallory"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, nil)
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s|%s|%s", r.Header.Get("X-Client-Verify"), r.Header.Get("X-Client-Subject"), r.Header.Get("X-Client-Sans"))
+	}))
+	defer backend.Close()
+
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--domain", "public.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/api:" + backend.URL,
+		"--domain", "secure.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--client-ca", path.Join(dir, "client_ca.pem"),
+		"--proxy", "/api:" + backend.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := httpsPort
+	request := func(serverName string, host string, cert *tls.Certificate) (string, int, error) {
+		tlsConfig := &tls.Config{InsecureSkipVerify: true, ServerName: serverName}
+		if cert != nil {
+			tlsConfig.Certificates = []tls.Certificate{*cert}
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		req, _ := http.NewRequest("GET", fmt.Sprintf("https://127.0.0.1:%d/api/", target), nil)
+		req.Host = host
+		req.Header.Set("X-Client-Subject", "CN=spoofed")
+		response, err := client.Do(req)
+		if err != nil {
+			return "", 0, err
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return string(body), response.StatusCode, nil
+	}
+
+	// 未开启客户端证书的域名不受影响，伪造的请求头会被删除
+	content, status, err := request("public.test", "public.test", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "NONE||", content)
+
+	_, _, err = request("secure.test", "secure.test", nil)
+	assert.NotNil(t, err)
+	_, _, err = request("secure.test", "secure.test", &otherCert)
+	assert.NotNil(t, err)
+
+	content, status, err = request("secure.test", "secure.test", &clientCert)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "SUCCESS|CN=alice,O=ops|email:alice@example.com", content)
+
+	// 通过其他域名的 TLS 连接访问需要客户端证书的域名
+	_, status, err = request("public.test", "secure.test", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusMisdirectedRequest, status)
+
+	// 明文请求重定向到 https，没有 https 端口时拒绝
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	plain := func(port int) *http.Response {
+		req, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/api/", port), nil)
+		req.Host = "secure.test"
+		response, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response
+	}
+	response := plain(httpPort)
+	assert.Equal(t, http.StatusPermanentRedirect, response.StatusCode)
+	assert.Equal(t, fmt.Sprintf("https://secure.test:%d/api/", httpsPort), response.Header.Get("Location"))
+
+	port++
+	plainPort := port
+	err = static.RunServer([]string{
+		"--listen", fmt.Sprintf("127.0.0.1:%d", plainPort),
+		"--domain", "secure.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--client-ca", path.Join(dir, "client_ca.pem"),
+		"--client-auth", "require",
+		"--proxy", "/api:" + backend.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusForbidden, plain(plainPort).StatusCode)
+
+	// 设置了 client-ca 时 require 模式也要校验证书的签发者
+	port++
+	target = port
+	err = static.RunServer([]string{
+		"--port", "0",
+		"--https-port", fmt.Sprintf("%d", target),
+		"--domain", "secure.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--client-ca", path.Join(dir, "client_ca.pem"),
+		"--client-auth", "require",
+		"--proxy", "/api:" + backend.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = request("secure.test", "secure.test", &otherCert)
+	assert.NotNil(t, err)
+	content, _, err = request("secure.test", "secure.test", &clientCert)
+	assert.Nil(t, err)
+	assert.Equal(t, "SUCCESS|CN=alice,O=ops|email:alice@example.com", content)
+
+	// verify 模式没有 client-ca 时启动失败
+	port++
+	err = static.RunServer([]string{
+		"--port", "0",
+		"--https-port", fmt.Sprintf("%d", port),
+		"--domain", "secure.test",
+		"--client-auth", "verify",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestTLSOptions(t *testing.T) {
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--domain", "default.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--domain", "modern.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--tls-preset", "modern",
+		"--domain", "legacy.test",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--tls-max-version", "1.2",
+		"--tls-ciphers", "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		"--tls-curves", "P-384",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshake := func(serverName string, config *tls.Config) (tls.ConnectionState, error) {
+		config.InsecureSkipVerify = true
+		config.ServerName = serverName
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpsPort), config)
+		if err != nil {
+			return tls.ConnectionState{}, err
+		}
+		defer conn.Close()
+		return conn.ConnectionState(), nil
+	}
+
+	state, err := handshake("default.test", &tls.Config{MaxVersion: tls.VersionTLS12})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+
+	_, err = handshake("modern.test", &tls.Config{MaxVersion: tls.VersionTLS12})
+	assert.NotNil(t, err)
+	state, err = handshake("modern.test", &tls.Config{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), state.Version)
+
+	state, err = handshake("legacy.test", &tls.Config{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), state.Version)
+	assert.Equal(t, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, state.CipherSuite)
+	_, err = handshake("legacy.test", &tls.Config{CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}})
+	assert.NotNil(t, err)
+	_, err = handshake("legacy.test", &tls.Config{CurvePreferences: []tls.CurveID{tls.X25519}})
+	assert.NotNil(t, err)
+
+	// 无效的参数在启动时报错
+	port++
+	httpPort = port
+	port++
+	err = static.RunServer([]string{"--port", fmt.Sprintf("%d", httpPort), "--https-port", fmt.Sprintf("%d", port), "--domain", "bad.test", "--tls-preset", "old"})
+	assert.NotNil(t, err)
+}
+
+func TestHTTP2(t *testing.T) {
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--h2c", "on",
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}
+	response, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://localhost:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 2, response.ProtoMajor)
+
+	// 同一个端口的明文请求仍然重定向到 https
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	response, err = client.Get(fmt.Sprintf("http://localhost:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusMovedPermanently, response.StatusCode)
+
+	// h2c prior knowledge
+	h2cTransport := &http.Transport{Protocols: &http.Protocols{}}
+	h2cTransport.Protocols.SetUnencryptedHTTP2(true)
+	response, err = (&http.Client{Transport: h2cTransport}).Get(fmt.Sprintf("http://localhost:%d/", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 2, response.ProtoMajor)
+
+	// h2c upgrade
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	status, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "HTTP/1.1 101 Switching Protocols\r\n", status)
+}
+
+func TestHTTP3(t *testing.T) {
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--http3", "on",
+		"--http3-udp-buffer", "1m",
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	response, err := (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://localhost:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, fmt.Sprintf(`h3=":%d"; ma=2592000`, httpsPort), response.Header.Get("Alt-Svc"))
+
+	h3Transport := &http3.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer h3Transport.Close()
+	response, err = (&http.Client{Transport: h3Transport}).Get(fmt.Sprintf("https://localhost:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, 3, response.ProtoMajor)
+	assert.NotEmpty(t, body)
+}
+
+func TestCACommands(t *testing.T) {
+	configDir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", configDir)
+	rootDir := path.Join(configDir, "ikrong/mini-http")
+
+	var out strings.Builder
+	assert.Nil(t, static.RunCA([]string{"path"}, &out))
+	assert.Contains(t, out.String(), path.Join(rootDir, "root.crt"))
+
+	out.Reset()
+	assert.Nil(t, static.RunCA([]string{"export"}, &out))
+	block, _ := pem.Decode([]byte(out.String()))
+	assert.NotNil(t, block)
+	root, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+
+	derFile := path.Join(t.TempDir(), "root.der")
+	assert.Nil(t, static.RunCA([]string{"export", "--format", "der", "--out", derFile}, io.Discard))
+	der, _ := os.ReadFile(derFile)
+	assert.Equal(t, root.Raw, der)
+
+	dir := t.TempDir()
+	out.Reset()
+	assert.Nil(t, static.RunCA([]string{"issue", "app.test", "--cert", path.Join(dir, "app.crt"), "--key", path.Join(dir, "app.key")}, &out))
+	cert, err := tls.LoadX509KeyPair(path.Join(dir, "app.crt"), path.Join(dir, "app.key"))
+	assert.Nil(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(root)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "app.test", Roots: pool})
+	assert.Nil(t, err)
+	info, _ := os.Stat(path.Join(dir, "app.key"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	out.Reset()
+	assert.Nil(t, static.RunCA([]string{"inspect"}, &out))
+	assert.Contains(t, out.String(), "Issued: \t1")
+	assert.Contains(t, out.String(), "DNS:app.test")
+
+	out.Reset()
+	assert.Nil(t, static.RunCA([]string{"rotate"}, &out))
+	content, _ := os.ReadFile(path.Join(rootDir, "root.crt"))
+	block, _ = pem.Decode(content)
+	assert.NotEqual(t, root.Raw, block.Bytes)
+	out.Reset()
+	assert.Nil(t, static.RunCA([]string{"inspect"}, &out))
+	assert.Contains(t, out.String(), "Issued: \t0")
+
+	assert.NotNil(t, static.RunCA([]string{"issue"}, io.Discard))
+	assert.NotNil(t, static.RunCA([]string{"unknown"}, io.Discard))
+	out.Reset()
+	assert.Nil(t, static.RunCA([]string{"help"}, &out))
+	assert.Contains(t, out.String(), "trust-install")
+}
+
+func TestCAOptions(t *testing.T) {
+	dial := func(httpsPort int, roots *x509.CertPool) (*tls.Conn, error) {
+		return tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpsPort), &tls.Config{ServerName: "localhost", RootCAs: roots})
+	}
+
+	// 自定义目录和 subject
+	caDir := t.TempDir()
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--ca-dir", caDir,
+		"--ca-subject", "CN=Test Dev CA,O=Example",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial(httpsPort, x509.NewCertPool())
+	assert.NotNil(t, err)
+	content, err := os.ReadFile(path.Join(caDir, "root.crt"))
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(content)
+	conn, err := dial(httpsPort, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	assert.Equal(t, "CN=Test Dev CA,O=Example", conn.ConnectionState().PeerCertificates[0].Issuer.String())
+	info, _ := os.Stat(path.Join(caDir, "root.key"))
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// 使用已有的中间证书签发
+	dir := t.TempDir()
+	root := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Corp Root"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	intermediate := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(2),
+		Subject:               pkix.Name{CommonName: "Corp Intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, &root)
+	writeTestCertificateFiles(t, intermediate, path.Join(dir, "ca.crt"), path.Join(dir, "ca.key"))
+	port++
+	httpPort = port
+	port++
+	httpsPort = port
+	err = static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--ca-dir", t.TempDir(),
+		"--ca-cert", path.Join(dir, "ca.crt"),
+		"--ca-key", path.Join(dir, "ca.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots = x509.NewCertPool()
+	roots.AddCert(root.Leaf)
+	conn, err = dial(httpsPort, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	assert.Equal(t, "Corp Intermediate", conn.ConnectionState().PeerCertificates[0].Issuer.CommonName)
+
+	// 无效的 CA 在启动时报错
+	leaf := createTestCertificate(t, &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "leaf"}}, &root)
+	writeTestCertificateFiles(t, leaf, path.Join(dir, "leaf.crt"), path.Join(dir, "leaf.key"))
+	for _, args := range [][]string{
+		{"--ca-cert", path.Join(dir, "leaf.crt"), "--ca-key", path.Join(dir, "leaf.key")},
+		{"--ca-cert", path.Join(dir, "ca.crt"), "--ca-key", path.Join(dir, "leaf.key")},
+		{"--ca-cert", path.Join(dir, "ca.crt")},
+		{"--ca-subject", "O=Example"},
+	} {
+		port++
+		err = static.RunServer(append([]string{"--port", fmt.Sprintf("%d", port), "--ca-dir", t.TempDir()}, args...))
+		assert.NotNil(t, err, args)
+	}
+}
+
+func TestLeafCertificates(t *testing.T) {
+	caDir := t.TempDir()
+	assert.Nil(t, static.RunCA([]string{"export", "--ca-dir", caDir}, io.Discard))
+	root, err := tls.LoadX509KeyPair(path.Join(caDir, "root.crt"), path.Join(caDir, "root.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root.Leaf)
+
+	// 快要过期的证书会重新签发
+	os.MkdirAll(path.Join(caDir, "issued"), 0700)
+	expiring := createTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(12345),
+		Subject:      pkix.Name{CommonName: "renew.test"},
+		DNSNames:     []string{"renew.test"},
+		NotAfter:     time.Now().Add(10 * 24 * time.Hour),
+	}, &root)
+	writeTestCertificateFiles(t, expiring, path.Join(caDir, "issued/renew.test.crt"), path.Join(caDir, "issued/renew.test.key"))
+
+	start := func() (int, int) {
+		port++
+		httpPort := port
+		port++
+		httpsPort := port
+		err := static.RunServer([]string{
+			"--port", fmt.Sprintf("%d", httpPort),
+			"--https-port", fmt.Sprintf("%d", httpsPort),
+			"--ca-dir", caDir,
+			"--domain", "main.test",
+			"--alias", "www.main.test",
+			"--root", fmt.Sprintf("%s/assets/domain/example.com/", currentDir),
+			"--domain", "*.wild.test",
+			"--root", fmt.Sprintf("%s/assets/domain/example.net/", currentDir),
+			"--domain", "renew.test",
+			"--root", fmt.Sprintf("%s/assets/domain/example.io/", currentDir),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return httpPort, httpsPort
+	}
+	httpPort, httpsPort := start()
+	dial := func(httpsPort int, serverName string) *x509.Certificate {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpsPort), &tls.Config{ServerName: serverName, RootCAs: roots})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0]
+	}
+
+	// 通过 IP 访问时没有 SNI，证书包含本机 IP 和所有域名
+	leaf := dial(httpsPort, "")
+	assert.Equal(t, []string{"localhost", "main.test", "www.main.test", "*.wild.test", "renew.test"}, leaf.DNSNames)
+	assert.Nil(t, leaf.VerifyHostname("127.0.0.1"))
+
+	main := dial(httpsPort, "www.main.test")
+	assert.Equal(t, []string{"main.test", "www.main.test"}, main.DNSNames)
+	assert.Equal(t, []string{"*.wild.test"}, dial(httpsPort, "a.wild.test").DNSNames)
+
+	renewed := dial(httpsPort, "renew.test")
+	assert.NotEqual(t, int64(12345), renewed.SerialNumber.Int64())
+	assert.True(t, renewed.NotAfter.After(time.Now().Add(300*24*time.Hour)))
+
+	// 别名和通配符域名使用对应的静态资源
+	for host, content := range map[string]string{"www.main.test": "example.com", "b.wild.test": "example.net", "renew.test": "example.io"} {
+		request, _ := http.NewRequest("GET", fmt.Sprintf("http://127.0.0.1:%d/", httpPort), nil)
+		request.Host = host
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(response.Body)
+		response.Body.Close()
+		assert.Equal(t, content, string(body))
+	}
+
+	// 重启后继续使用保存的证书
+	_, httpsPort = start()
+	assert.Equal(t, main.SerialNumber, dial(httpsPort, "main.test").SerialNumber)
+	assert.Equal(t, renewed.SerialNumber, dial(httpsPort, "renew.test").SerialNumber)
+}
+
+func TestOCSPStapling(t *testing.T) {
+	issuer := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "OCSP Test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}, nil)
+	var requests atomic.Int32
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil || r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		response, _ := ocsp.CreateResponse(issuer.Leaf, issuer.Leaf, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, issuer.PrivateKey.(*ecdsa.PrivateKey))
+		w.Write(response)
+	}))
+	defer responder.Close()
+
+	dir := t.TempDir()
+	for i, name := range []string{"good", "fail"} {
+		leaf := createTestCertificate(t, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(i + 2)),
+			Subject:      pkix.Name{CommonName: name + ".test"},
+			DNSNames:     []string{name + ".test"},
+			OCSPServer:   []string{responder.URL + "/" + name},
+		}, &issuer)
+		leaf.Certificate = append(leaf.Certificate, issuer.Certificate[0])
+		writeTestCertificateFiles(t, leaf, path.Join(dir, name+".crt"), path.Join(dir, name+".key"))
+	}
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--cert-reload-interval", "50ms",
+		"--domain", "good.test",
+		"--cert", path.Join(dir, "good.crt"),
+		"--key", path.Join(dir, "good.key"),
+		"--domain", "fail.test",
+		"--cert", path.Join(dir, "fail.crt"),
+		"--key", path.Join(dir, "fail.key"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	staple := func(serverName string) []byte {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpsPort), &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().OCSPResponse
+	}
+
+	assert.Eventually(t, func() bool { return staple("good.test") != nil }, 2*time.Second, 20*time.Millisecond)
+	response, err := ocsp.ParseResponse(staple("good.test"), issuer.Leaf)
+	assert.Nil(t, err)
+	assert.Equal(t, ocsp.Good, response.Status)
+
+	// 获取失败时不影响握手
+	assert.Eventually(t, func() bool { return requests.Load() >= 2 }, 2*time.Second, 20*time.Millisecond)
+	assert.Nil(t, staple("fail.test"))
+
+	// 证书文件更新但内容不变时，新加载的证书继续附加已有的响应
+	count := requests.Load()
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(path.Join(dir, "good.crt"), later, later)
+	time.Sleep(300 * time.Millisecond)
+	assert.NotNil(t, staple("good.test"))
+	assert.Equal(t, count, requests.Load())
+}
+
+func TestForceHTTPS(t *testing.T) {
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--force-https", "on",
+		"--hsts-max-age", "31536000",
+		"--hsts-include-subdomains", "on",
+		"--hsts-preload", "on",
+		"--domain", "127.0.0.1",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--force-https", "308",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	response, err := client.Get(fmt.Sprintf("http://localhost:%d/index.html?a=1", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusMovedPermanently, response.StatusCode)
+	assert.Equal(t, fmt.Sprintf("https://localhost:%d/index.html?a=1", httpsPort), response.Header.Get("Location"))
+	assert.Empty(t, response.Header.Get("Strict-Transport-Security"))
+
+	response, err = client.Post(fmt.Sprintf("http://127.0.0.1:%d/", httpPort), "text/plain", strings.NewReader("body"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusPermanentRedirect, response.StatusCode)
+	assert.Equal(t, fmt.Sprintf("https://127.0.0.1:%d/", httpsPort), response.Header.Get("Location"))
+
+	// ACME 验证路径不重定向
+	response, err = client.Get(fmt.Sprintf("http://localhost:%d/.well-known/acme-challenge/token", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	response, err = (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://localhost:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.Equal(t, "max-age=31536000; includeSubDomains; preload", response.Header.Get("Strict-Transport-Security"))
+
+	response, err = (&http.Client{Transport: transport}).Get(fmt.Sprintf("https://127.0.0.1:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Empty(t, response.Header.Get("Strict-Transport-Security"))
+}
+
+func TestListen(t *testing.T) {
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	port++
+	autoPort := port
+	socket := path.Join(t.TempDir(), "serve.sock")
+	err := static.RunServer([]string{
+		"--listen", fmt.Sprintf("127.0.0.1:%d", httpPort),
+		"--listen-domain", "localhost",
+		"--listen", fmt.Sprintf("[::1]:%d", httpsPort),
+		"--listen-protocol", "https",
+		"--listen", fmt.Sprintf("127.0.0.1:%d", autoPort),
+		"--listen-protocol", "auto",
+		"--listen", "unix:" + socket,
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--domain", "example.com",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(client *http.Client, url string, host string) int {
+		request, _ := http.NewRequest(http.MethodGet, url, nil)
+		request.Host = host
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		return response.StatusCode
+	}
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	// 只处理 localhost
+	assert.Equal(t, http.StatusOK, get(client, fmt.Sprintf("http://127.0.0.1:%d/", httpPort), "localhost"))
+	assert.Equal(t, http.StatusMisdirectedRequest, get(client, fmt.Sprintf("http://127.0.0.1:%d/", httpPort), "example.com"))
+
+	tlsClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	assert.Equal(t, http.StatusOK, get(tlsClient, fmt.Sprintf("https://[::1]:%d/", httpsPort), "example.com"))
+	assert.Equal(t, http.StatusOK, get(tlsClient, fmt.Sprintf("https://127.0.0.1:%d/", autoPort), "localhost"))
+	assert.Equal(t, http.StatusMovedPermanently, get(client, fmt.Sprintf("http://127.0.0.1:%d/", autoPort), "localhost"))
+
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	assert.Equal(t, http.StatusOK, get(unixClient, "http://localhost/", "localhost"))
+
+	// 没有 --port 时不监听 80 端口，协议错误时启动失败
+	err = static.RunServer([]string{
+		"--listen", fmt.Sprintf("127.0.0.1:%d", httpPort+100),
+		"--listen-protocol", "quic",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestUpgrade(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("upgrade is not supported on windows")
+	}
+	dir := t.TempDir()
+	binary := path.Join(dir, "serve")
+	build := exec.Command("go", "build", "-o", binary, ".")
+	build.Dir = currentDir
+	if output, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %s", err, output)
+	}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+		w.Write([]byte("done"))
+	}))
+	defer backend.Close()
+
+	// 没有 --listen 时继承的 socket 按 http 处理
+	for _, listen := range []bool{true, false} {
+		t.Run(fmt.Sprintf("listen=%v", listen), func(t *testing.T) {
+			// 模拟 systemd 传入的 socket
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			address := ln.Addr().String()
+			file, err := ln.(*net.TCPListener).File()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ln.Close()
+			output, err := os.Create(path.Join(dir, fmt.Sprintf("output-%v.log", listen)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer output.Close()
+			args := []string{
+				"--domain", "localhost",
+				"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+				"--proxy", "/slow:" + backend.URL,
+			}
+			if listen {
+				args = append([]string{"--listen", address}, args...)
+			}
+			cmd := exec.Command("sh", append([]string{"-c", `LISTEN_PID=$$ LISTEN_FDS=1 exec "$0" "$@"`, binary}, args...)...)
+			cmd.ExtraFiles = []*os.File{file}
+			cmd.Stdout, cmd.Stderr = output, output
+			if err = cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			file.Close()
+			defer cmd.Process.Kill()
+
+			get := func(path string) (string, error) {
+				response, err := http.Get(fmt.Sprintf("http://%s%s", address, path))
+				if err != nil {
+					return "", err
+				}
+				defer response.Body.Close()
+				body, err := io.ReadAll(response.Body)
+				return string(body), err
+			}
+			assert.Eventually(t, func() bool {
+				_, err := get("/")
+				return err == nil
+			}, 5*time.Second, 20*time.Millisecond)
+
+			slow := make(chan string, 1)
+			go func() {
+				body, _ := get("/slow")
+				slow <- body
+			}()
+			time.Sleep(200 * time.Millisecond)
+			if err = cmd.Process.Signal(static.UpgradeSignal); err != nil {
+				t.Fatal(err)
+			}
+
+			// 升级期间请求不会被拒绝，旧进程处理完请求后退出
+			exited := make(chan error, 1)
+			go func() { exited <- cmd.Wait() }()
+			for done := false; !done; {
+				select {
+				case err = <-exited:
+					done = true
+				case <-time.After(20 * time.Millisecond):
+					_, err := get("/")
+					assert.Nil(t, err)
+				}
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, "done", <-slow)
+			_, err = get("/")
+			assert.Nil(t, err)
+
+			content, _ := os.ReadFile(output.Name())
+			var pid int
+			for _, line := range strings.Split(string(content), "\n") {
+				if _, after, ok := strings.Cut(line, "upgrade: started new process "); ok {
+					pid, _ = strconv.Atoi(after)
+				}
+			}
+			// 新进程同样只使用继承的 socket，不会再监听 80 端口
+			assert.NotContains(t, string(content), "Listen TCP: 80", string(content))
+			if assert.NotZero(t, pid, string(content)) {
+				process, _ := os.FindProcess(pid)
+				process.Signal(syscall.SIGTERM)
+			}
+		})
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-For")))
+	}))
+	defer backend.Close()
+	port++
+	trustedPort := port
+	port++
+	untrustedPort := port
+	port++
+	tlsPort := port
+	err := static.RunServer([]string{
+		"--listen", fmt.Sprintf("127.0.0.1:%d", trustedPort),
+		"--listen-proxy-protocol", "10.0.0.0/8,127.0.0.1",
+		"--listen", fmt.Sprintf("127.0.0.1:%d", untrustedPort),
+		"--listen-proxy-protocol", "10.0.0.0/8",
+		"--listen", fmt.Sprintf("127.0.0.1:%d", tlsPort),
+		"--listen-protocol", "https",
+		"--listen-proxy-protocol", "127.0.0.0/8",
+		"--domain", "localhost",
+		"--proxy", "/ip:" + backend.URL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(port int, header string, useTLS bool) (string, error) {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		conn.Write([]byte(header))
+		if useTLS {
+			conn = tls.Client(conn, &tls.Config{ServerName: "localhost", InsecureSkipVerify: true})
+		}
+		fmt.Fprintf(conn, "GET /ip HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n")
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return "", err
+		}
+		defer response.Body.Close()
+		body, err := io.ReadAll(response.Body)
+		if response.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("status %d", response.StatusCode)
+		}
+		return string(body), err
+	}
+	v2 := func(ip net.IP, port uint16) string {
+		header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x21, 0, 36)
+		header = append(header, ip.To16()...)
+		header = append(header, net.IPv6loopback...)
+		header = append(header, byte(port>>8), byte(port), 0, 80)
+		return string(header)
+	}
+
+	body, err := request(trustedPort, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 80\r\n", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "203.0.113.7", body)
+
+	body, err = request(trustedPort, v2(net.ParseIP("2001:db8::1"), 51234), false)
+	assert.Nil(t, err)
+	assert.Equal(t, "2001:db8::1", body)
+
+	// 可信来源没有发送 PROXY 头时使用连接地址
+	body, err = request(trustedPort, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", body)
+
+	// 不可信来源的 PROXY 头不会被解析
+	_, err = request(untrustedPort, "PROXY TCP4 203.0.113.7 127.0.0.1 51234 80\r\n", false)
+	assert.NotNil(t, err)
+	body, err = request(untrustedPort, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1", body)
+
+	body, err = request(tlsPort, "PROXY TCP4 198.51.100.9 127.0.0.1 51234 443\r\n", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "198.51.100.9", body)
+
+	// 格式错误的 PROXY 头直接断开连接
+	_, err = request(trustedPort, "PROXY TCP4 not-an-ip 127.0.0.1 51234 80\r\n", false)
+	assert.NotNil(t, err)
+
+	err = static.RunServer([]string{
+		"--listen", fmt.Sprintf("127.0.0.1:%d", untrustedPort+100),
+		"--listen-proxy-protocol", "10.0.0.0/33",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestTrustedProxies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Real-IP") + "|" + r.Header.Get("X-Forwarded-For")))
+	}))
+	defer backend.Close()
+	start := func(args ...string) int {
+		port++
+		err := static.RunServer(append([]string{
+			"--port", fmt.Sprintf("%d", port),
+			"--domain", "localhost",
+			"--proxy", "/ip:" + backend.URL,
+			"--cache-purge", "/_purge",
+		}, args...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return port
+	}
+	request := func(port int, method string, path string, header http.Header) (int, string) {
+		req, _ := http.NewRequest(method, fmt.Sprintf("http://localhost:%d%s", port, path), nil)
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		response, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		body, _ := io.ReadAll(response.Body)
+		return response.StatusCode, string(body)
+	}
+
+	// 不信任时忽略请求头，伪造的 X-Real-IP 会被覆盖
+	direct := start()
+	_, body := request(direct, http.MethodGet, "/ip", http.Header{
+		"X-Forwarded-For": {"198.51.100.1"},
+		"X-Real-Ip":       {"198.51.100.1"},
+	})
+	assert.Equal(t, "127.0.0.1|198.51.100.1, 127.0.0.1", body)
+
+	xff := start("--trusted-proxies", "127.0.0.1,10.0.0.0/8")
+	_, body = request(xff, http.MethodGet, "/ip", http.Header{
+		"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.5"},
+	})
+	assert.Equal(t, "198.51.100.1|203.0.113.9, 198.51.100.1, 10.0.0.5, 127.0.0.1", body)
+	_, body = request(xff, http.MethodGet, "/ip", http.Header{
+		"X-Forwarded-For": {"unknown, 10.0.0.5"},
+	})
+	assert.Equal(t, "10.0.0.5|unknown, 10.0.0.5, 127.0.0.1", body)
+	// 经过可信代理的请求不能再访问只允许本机的接口
+	code, _ := request(xff, http.MethodPost, "/_purge", http.Header{"X-Forwarded-For": {"198.51.100.1"}})
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = request(xff, http.MethodPost, "/_purge", nil)
+	assert.Equal(t, http.StatusOK, code)
+
+	cf := start("--trusted-proxies", "127.0.0.0/8", "--real-ip-header", "CF-Connecting-IP")
+	_, body = request(cf, http.MethodGet, "/ip", http.Header{
+		"Cf-Connecting-Ip": {"2001:db8::1"},
+		"X-Forwarded-For":  {"198.51.100.1"},
+	})
+	assert.Equal(t, "2001:db8::1|198.51.100.1, 127.0.0.1", body)
+
+	forwarded := start("--trusted-proxies", "127.0.0.1,192.0.2.0/24", "--real-ip-header", "Forwarded")
+	_, body = request(forwarded, http.MethodGet, "/ip", http.Header{
+		"Forwarded": {`for="[2001:db8:cafe::17]:4711";proto=https, for=192.0.2.43`},
+	})
+	assert.Equal(t, "2001:db8:cafe::17|127.0.0.1", body)
+
+	port++
+	err := static.RunServer([]string{"--port", fmt.Sprintf("%d", port), "--trusted-proxies", "not-a-cidr"})
+	assert.NotNil(t, err)
+}
+
+func TestServerLimits(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(brw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		brw.Flush()
+		io.Copy(conn, brw)
+	}))
+	defer backend.Close()
+	port++
+	httpPort := port
+	port++
+	httpsPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--https-port", fmt.Sprintf("%d", httpsPort),
+		"--read-header-timeout", "300ms",
+		"--read-timeout", "300ms",
+		"--write-timeout", "300ms",
+		"--max-header-bytes", "1k",
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+		"--proxy", "/ws:" + strings.Replace(backend.URL, "http", "ws", 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, err := bufio.NewReader(conn).ReadByte()
+		return err == io.EOF
+	}
+
+	// 不发送数据的连接不影响 https 端口接受新连接，并在超时后被关闭
+	silent, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	response, err := (&http.Client{Transport: transport, Timeout: time.Second}).Get(fmt.Sprintf("https://localhost:%d/", httpsPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	assert.True(t, closed(silent))
+
+	// 请求头发送太慢
+	slow, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	fmt.Fprintf(slow, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	assert.True(t, closed(slow))
+
+	request, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://localhost:%d/", httpPort), nil)
+	request.Header.Set("Cookie", strings.Repeat("a", 8<<10))
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, response.StatusCode)
+
+	// websocket 劫持后不受读写超时限制
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	reader := bufio.NewReader(conn)
+	response, err = http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusSwitchingProtocols, response.StatusCode)
+	time.Sleep(500 * time.Millisecond)
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = io.ReadFull(reader, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "ping", string(buf))
+}
+
+func TestMaxConnections(t *testing.T) {
+	port++
+	httpPort := port
+	err := static.RunServer([]string{
+		"--port", fmt.Sprintf("%d", httpPort),
+		"--max-connections", "1",
+		"--domain", "localhost",
+		"--root", fmt.Sprintf("%s/assets/domain/localhost/", currentDir),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func() error {
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 300 * time.Millisecond}
+		response, err := client.Get(fmt.Sprintf("http://localhost:%d/", httpPort))
+		if err == nil {
+			response.Body.Close()
+		}
+		return err
+	}
+
+	first, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", httpPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(first, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	response, err := http.ReadResponse(bufio.NewReader(first), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+
+	// 保持连接时达到上限，新连接需要等待
+	assert.NotNil(t, get())
+	first.Close()
+	assert.Eventually(t, func() bool { return get() == nil }, 2*time.Second, 50*time.Millisecond)
+}
+
 func TestMain(m *testing.M) {
 	// 获取当前文件夹
 	currentDir, _ = os.Getwd()
@@ -0,0 +1,109 @@
+package static
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+// 为开启 --acme 的域名自动申请和续期证书，HTTP-01 验证走 HTTPPort，TLS-ALPN-01 验证走 HTTPSPort
+func newACMEManager(c *ServerConfig) (*autocert.Manager, error) {
+	var hosts []string
+	for _, domain := range c.Domains {
+		if !domain.ACME {
+			continue
+		}
+		// HTTP-01 和 TLS-ALPN-01 验证不支持通配符域名
+		for _, name := range domain.names() {
+			if !strings.HasPrefix(name, "*.") {
+				hosts = append(hosts, name)
+			}
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+
+	dir := c.ACMEDir
+	if dir == "" {
+		rootDir, err := newCA(c).getRootDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = path.Join(rootDir, "acme")
+	}
+	client := &acme.Client{DirectoryURL: c.ACMEDirectory}
+	if client.DirectoryURL == "" {
+		client.DirectoryURL = acme.LetsEncryptURL
+	}
+	if c.ACMECA != "" {
+		// 本地测试用的 ACME 服务（例如 Pebble）使用自签名证书
+		pem, err := os.ReadFile(c.ACMECA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("invalid acme ca %s", c.ACMECA)
+		}
+		client.HTTPClient = &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}}
+	}
+	return &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(dir),
+		HostPolicy:  autocert.HostWhitelist(hosts...),
+		Email:       c.ACMEEmail,
+		Client:      client,
+		RenewBefore: 30 * 24 * time.Hour,
+	}, nil
+}
+
+// 处理 HTTP-01 验证请求，其余请求重定向到 https
+func handleACMEHTTP(manager *autocert.Manager, httpsPort int, w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		// autocert 校验域名时不会去掉端口，HTTPPort 不是 80 时需要先去掉
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			r = r.Clone(r.Context())
+			r.Host = host
+		}
+		manager.HTTPHandler(nil).ServeHTTP(w, r)
+		return
+	}
+	redirectToHTTPS(w, r, httpsPort, http.StatusMovedPermanently)
+}
+
+// 重定向到 https，port 不是 443 时带上端口
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request, port int, code int) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if port != 443 && port != 0 {
+		host = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	u := url.URL{
+		Scheme:   "https",
+		Host:     host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	http.Redirect(w, r, u.String(), code)
+}
@@ -1,6 +1,7 @@
 package static
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
@@ -8,32 +9,83 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
 	"math/big"
+	"net"
 	"os"
 	"path"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
 
-var ca = CA{}
+const defaultCASubject = "CN=IKrong Root CA,O=IKrong Root CA"
 
 type CA struct {
+	// 保存根证书和签发证书的目录，默认为用户配置目录
+	Dir string
+	// 使用已有的根证书或中间证书签发，不再自动生成
+	CertFile string
+	KeyFile  string
+	// 自动生成根证书时使用的 subject，例如 CN=Dev Root CA,O=Example
+	Subject string
+
 	certByte []byte
 	keyByte  []byte
 	store    sync.Map
 	mu       sync.Mutex
 }
 
+func newCA(c *ServerConfig) *CA {
+	return &CA{
+		Dir:      c.CADir,
+		CertFile: c.CACert,
+		KeyFile:  c.CAKey,
+		Subject:  c.CASubject,
+	}
+}
+
 func (ca *CA) getRootDir() (rootDir string, err error) {
-	userDir, err := os.UserConfigDir()
+	rootDir = ca.Dir
+	if rootDir == "" {
+		userDir, err := os.UserConfigDir()
+		if err != nil {
+			userDir = "/tmp/"
+		}
+		rootDir = path.Join(userDir, "ikrong/mini-http")
+	}
+	// 目录中保存着私钥
+	err = os.MkdirAll(rootDir, 0700)
+	return
+}
+
+func (ca *CA) rootFiles() (certFile string, keyFile string, err error) {
+	if ca.CertFile != "" || ca.KeyFile != "" {
+		if ca.CertFile == "" || ca.KeyFile == "" {
+			err = errors.New("ca-cert and ca-key must be set together")
+		}
+		return ca.CertFile, ca.KeyFile, err
+	}
+	rootDir, err := ca.getRootDir()
 	if err != nil {
-		userDir = "/tmp/"
+		return
 	}
-	rootDir = path.Join(userDir, "ikrong/mini-http")
-	if _, err = os.Stat(rootDir); err != nil {
-		os.MkdirAll(rootDir, 0755)
-		err = nil
+	certFile = path.Join(rootDir, "root.crt")
+	keyFile = path.Join(rootDir, "root.key")
+	return
+}
+
+// 签发过的证书保存在 issued 目录，用于 serve ca inspect 查看
+func (ca *CA) issuedDir() (dir string, err error) {
+	rootDir, err := ca.getRootDir()
+	if err != nil {
+		return
 	}
+	dir = path.Join(rootDir, "issued")
+	err = os.MkdirAll(dir, 0700)
 	return
 }
 
@@ -41,38 +93,55 @@ func (ca *CA) generateRootCertificate() (err error) {
 	if ca.certByte != nil {
 		return
 	}
-	rootDir, err := ca.getRootDir()
+	certFile, keyFile, err := ca.rootFiles()
 	if err != nil {
 		return
 	}
-	certFile := path.Join(rootDir, "root.crt")
-	keyFile := path.Join(rootDir, "root.key")
 	var cert []byte
 	var key []byte
-	if _, err = os.Stat(certFile); err == nil {
-		if cert, err = os.ReadFile(certFile); err == nil {
-			if key, err = os.ReadFile(keyFile); err == nil {
-				ca.certByte = cert
-				ca.keyByte = key
-				return
+	if _, err = os.Stat(certFile); err == nil || ca.CertFile != "" {
+		if cert, err = os.ReadFile(certFile); err != nil {
+			return
+		}
+		if key, err = os.ReadFile(keyFile); err != nil {
+			return
+		}
+		if _, _, err = parseCAKeyPair(cert, key); err != nil {
+			return fmt.Errorf("invalid ca %s: %w", certFile, err)
+		}
+		if ca.CertFile == "" {
+			// 旧版本生成的私钥权限为 0644
+			if info, statErr := os.Stat(keyFile); statErr == nil && info.Mode().Perm()&0077 != 0 {
+				os.Chmod(keyFile, 0600)
 			}
 		}
+		ca.certByte = cert
+		ca.keyByte = key
+		return
 	}
 
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	subject, err := parseSubject(ca.Subject)
+	if err != nil {
+		return
+	}
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate root key: %w", err)
+	}
 
 	notBefore := time.Now()
 	notAfter := notBefore.Add(10 * 365 * 24 * time.Hour)
 
-	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return
+	}
 
 	// 设置证书模板
 	template := x509.Certificate{
-		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			Organization: []string{"IKrong Root CA"},
-			CommonName:   "IKrong Root CA",
-		},
+		SerialNumber:          serialNumber,
+		Subject:               subject,
 		NotBefore:             notBefore,
 		NotAfter:              notAfter,
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
@@ -81,17 +150,23 @@ func (ca *CA) generateRootCertificate() (err error) {
 		IsCA:                  true,
 	}
 
-	derBytes, _ := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return fmt.Errorf("create root certificate: %w", err)
+	}
 
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	pemBlock, _ := x509.MarshalECPrivateKey(priv)
+	pemBlock, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("marshal root key: %w", err)
+	}
 	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: pemBlock})
 
-	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
 		return
 	}
 
-	if err = os.WriteFile(keyFile, keyPEM, 0644); err != nil {
+	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
 		return
 	}
 	ca.certByte = certPEM
@@ -99,29 +174,124 @@ func (ca *CA) generateRootCertificate() (err error) {
 	return
 }
 
-func (ca *CA) issueCertificate(domain string) (*tls.Certificate, error) {
+// 签发的证书有效期为一年，到期前 30 天重新签发
+const leafRenewBefore = 30 * 24 * time.Hour
+
+// persist 为 true 时证书和私钥会保存到 issued 目录，重启后继续使用
+func (ca *CA) issueCertificate(names []string, ips []net.IP, persist bool) (*tls.Certificate, error) {
 	ca.mu.Lock()
 	defer ca.mu.Unlock()
 	if err := ca.generateRootCertificate(); err != nil {
 		return nil, err
 	}
-	if cert, ok := ca.store.Load(domain); ok {
+	storeKey := fmt.Sprint(names, ips)
+	if cert, ok := ca.store.Load(storeKey); ok && !needsRenewal(cert.(*tls.Certificate).Leaf) {
 		return cert.(*tls.Certificate), nil
 	}
+	if persist {
+		if cert := ca.loadIssued(names, ips); cert != nil {
+			ca.store.Store(storeKey, cert)
+			return cert, nil
+		}
+	}
+
+	certPEM, keyPEM, err := ca.createLeafCertificate(names, ips)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if persist {
+		ca.saveIssued(names[0], certPEM, keyPEM)
+	}
+
+	ca.store.Store(storeKey, &cert)
+
+	return &cert, nil
+}
+
+func needsRenewal(leaf *x509.Certificate) bool {
+	return leaf == nil || time.Until(leaf.NotAfter) < leafRenewBefore
+}
+
+// 读取之前签发的证书，域名、IP 不一致，不是当前 CA 签发或者快要过期时返回 nil
+func (ca *CA) loadIssued(names []string, ips []net.IP) *tls.Certificate {
+	certFile, keyFile, err := ca.issuedFiles(names[0])
+	if err != nil {
+		return nil
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil || cert.Leaf == nil || needsRenewal(cert.Leaf) {
+		return nil
+	}
+	chain, _, err := parseCAKeyPair(ca.certByte, ca.keyByte)
+	if err != nil || cert.Leaf.CheckSignatureFrom(chain[0]) != nil {
+		return nil
+	}
+	if fmt.Sprint(cert.Leaf.DNSNames) != fmt.Sprint(names) || fmt.Sprint(cert.Leaf.IPAddresses) != fmt.Sprint(ips) {
+		return nil
+	}
+	return &cert
+}
+
+func (ca *CA) issuedFiles(name string) (certFile string, keyFile string, err error) {
+	// 域名来自客户端的 SNI，不能包含路径
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", "", fmt.Errorf("invalid certificate name %s", name)
+	}
+	dir, err := ca.issuedDir()
+	if err != nil {
+		return
+	}
+	name = strings.ReplaceAll(name, "*", "_wildcard")
+	return path.Join(dir, name+".crt"), path.Join(dir, name+".key"), nil
+}
+
+// 没有私钥时只保存证书，用于 serve ca inspect 查看
+func (ca *CA) saveIssued(name string, certPEM []byte, keyPEM []byte) {
+	certFile, keyFile, err := ca.issuedFiles(name)
+	if err != nil {
+		return
+	}
+	if keyPEM != nil {
+		err = os.WriteFile(keyFile, keyPEM, 0600)
+	} else {
+		os.Remove(keyFile)
+	}
+	if err == nil {
+		err = os.WriteFile(certFile, certPEM, 0644)
+	}
+	if err != nil {
+		log.Printf("ca: save issued certificate of %s: %v", name, err)
+	}
+}
 
-	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// 返回的证书 PEM 包含签发它的中间证书
+func (ca *CA) createLeafCertificate(names []string, ips []net.IP) (certPEM []byte, keyPEM []byte, err error) {
+	chain, rootKey, err := parseCAKeyPair(ca.certByte, ca.keyByte)
+	if err != nil {
+		return
+	}
+	rootCert := chain[0]
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
 	notBefore := time.Now()
 	notAfter := notBefore.Add(365 * 24 * time.Hour)
-	serialNumber, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
-
-	rootCertBlock, _ := pem.Decode(ca.certByte)
-	rootCert, _ := x509.ParseCertificate(rootCertBlock.Bytes)
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return
+	}
 
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
-			Organization: []string{domain},
-			CommonName:   domain,
+			Organization: []string{names[0]},
+			CommonName:   names[0],
 		},
 		Issuer:                rootCert.Subject,
 		NotBefore:             notBefore,
@@ -129,22 +299,156 @@ func (ca *CA) issueCertificate(domain string) (*tls.Certificate, error) {
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
-		DNSNames:              []string{domain},
+		DNSNames:              names,
+		IPAddresses:           ips,
 	}
 
-	rootKeyBlock, _ := pem.Decode(ca.keyByte)
-	rootKey, _ := x509.ParseECPrivateKey(rootKeyBlock.Bytes)
+	derBytes, err := x509.CreateCertificate(rand.Reader, &template, rootCert, &priv.PublicKey, rootKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create certificate of %s: %w", names[0], err)
+	}
 
-	derBytes, _ := x509.CreateCertificate(rand.Reader, &template, rootCert, &priv.PublicKey, rootKey)
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	// 自签名的根证书不需要发给客户端
+	for _, cert := range chain {
+		if !isSelfSigned(cert) {
+			certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+		}
+	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	pemBlock, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: pemBlock})
+	return
+}
 
-	pemBlock, _ := x509.MarshalECPrivateKey(priv)
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: pemBlock})
+// 证书中包含的域名和 IP：
+// 没有 SNI 或者访问 localhost 时包含所有配置的域名、别名以及本机 IP；
+// 匹配到配置的域名时包含该域名和它的别名，通配符域名签发通配符证书；
+// 其他 SNI 只包含自身，并且不保存到磁盘
+func (c *ServerConfig) certificateNames(serverName string) (names []string, ips []net.IP, known bool) {
+	if serverName == "" || serverName == "localhost" || net.ParseIP(serverName) != nil {
+		names = []string{"localhost"}
+		for _, domain := range c.Domains {
+			for _, name := range domain.names() {
+				if !slices.Contains(names, name) {
+					names = append(names, name)
+				}
+			}
+		}
+		return names, localIPs(), true
+	}
+	if domain, ok := c.matchDomain(serverName); ok {
+		return domain.names(), nil, true
+	}
+	return []string{serverName}, nil, false
+}
+
+func localIPs() []net.IP {
+	ips := []net.IP{net.IPv4(127, 0, 0, 1).To4(), net.IPv6loopback}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsLoopback() {
+			continue
+		}
+		ip := ipNet.IP
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// 证书文件中可以带上完整的证书链，第一个证书用于签发
+func parseCAKeyPair(certPEM []byte, keyPEM []byte) (chain []*x509.Certificate, key crypto.Signer, err error) {
+	for rest := certPEM; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, nil, errors.New("no certificate found")
+	}
+	if !chain[0].IsCA {
+		return nil, nil, errors.New("certificate is not a ca")
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, nil, errors.New("no private key found")
+	}
+	var parsed any
+	if parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+		if parsed, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+			if parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, nil, errors.New("unsupported private key")
+			}
+		}
+	}
+	key, ok := parsed.(crypto.Signer)
+	if !ok {
+		return nil, nil, errors.New("unsupported private key")
+	}
+	if _, err = tls.X509KeyPair(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[0].Raw}), keyPEM); err != nil {
+		return nil, nil, err
+	}
+	return chain, key, nil
+}
 
-	cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+func isSelfSigned(cert *x509.Certificate) bool {
+	return cert.CheckSignatureFrom(cert) == nil
+}
 
-	ca.store.Store(domain, &cert)
+func randomSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number: %w", err)
+	}
+	return serialNumber, nil
+}
 
-	return &cert, nil
+// 解析 CN=Dev Root CA,O=Example,OU=Dev,C=CN 形式的 subject
+func parseSubject(subject string) (name pkix.Name, err error) {
+	if subject == "" {
+		subject = defaultCASubject
+	}
+	for _, part := range strings.Split(subject, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || value == "" {
+			return name, fmt.Errorf("invalid ca subject %s", subject)
+		}
+		switch strings.ToUpper(key) {
+		case "CN":
+			name.CommonName = value
+		case "O":
+			name.Organization = append(name.Organization, value)
+		case "OU":
+			name.OrganizationalUnit = append(name.OrganizationalUnit, value)
+		case "C":
+			name.Country = append(name.Country, value)
+		case "ST":
+			name.Province = append(name.Province, value)
+		case "L":
+			name.Locality = append(name.Locality, value)
+		default:
+			return name, fmt.Errorf("unsupported ca subject attribute %s", key)
+		}
+	}
+	if name.CommonName == "" {
+		return name, fmt.Errorf("ca subject %s requires CN", subject)
+	}
+	return
 }
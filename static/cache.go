@@ -0,0 +1,576 @@
+package static
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCacheSize       = 256 << 20
+	cacheRevalidateTimeout = 30 * time.Second
+)
+
+// 缓存代理的 GET 请求，遵循 Cache-Control/Expires/Vary，支持 ETag/Last-Modified 协商，
+// 以及 stale-while-revalidate 和 stale-if-error
+type httpCache struct {
+	transport http.RoundTripper
+	maxSize   int64
+	dir       string
+
+	mu      sync.Mutex
+	size    int64
+	seq     int64
+	lru     *list.List
+	entries map[string]*list.Element
+	vary    map[string][]string
+	// 每个地址缓存的不同 Vary 版本数量，为 0 时删除 vary
+	variants map[string]int
+}
+
+type cacheEntry struct {
+	key         string
+	primary     string
+	path        string
+	status      int
+	header      http.Header
+	body        []byte
+	file        string
+	size        int64
+	responseAt  time.Time
+	initialAge  time.Duration
+	freshFor    time.Duration
+	staleRevive time.Duration
+	staleError  time.Duration
+	updating    bool
+}
+
+func newHTTPCache(transport http.RoundTripper, maxSize int64, dir string) *httpCache {
+	if maxSize <= 0 {
+		maxSize = defaultCacheSize
+	}
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Printf("cache: %v, fallback to memory", err)
+			dir = ""
+		} else {
+			// 索引只保存在内存中，启动时清理上次留下的缓存文件
+			files, _ := filepath.Glob(filepath.Join(dir, "*.cache"))
+			for _, f := range files {
+				os.Remove(f)
+			}
+		}
+	}
+	return &httpCache{
+		transport: transport,
+		maxSize:   maxSize,
+		dir:       dir,
+		lru:       list.New(),
+		entries:   map[string]*list.Element{},
+		vary:      map[string][]string{},
+		variants:  map[string]int{},
+	}
+}
+
+func (c *httpCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		res, err := c.transport.RoundTrip(req)
+		if err == nil && res.StatusCode < 400 && req.Method != http.MethodOptions {
+			// 修改类请求成功后，同一地址的缓存失效
+			c.remove(func(e *cacheEntry) bool { return e.primary == cachePrimaryKey(req) })
+		}
+		return withCacheStatus(res, "BYPASS"), err
+	}
+	reqCC := parseCacheControl(req.Header)
+	if _, ok := reqCC["no-store"]; ok || req.Header.Get("range") != "" {
+		res, err := c.transport.RoundTrip(req)
+		return withCacheStatus(res, "BYPASS"), err
+	}
+
+	primary := cachePrimaryKey(req)
+	entry := c.lookup(primary, req)
+	if entry == nil {
+		return c.fetch(req, primary, "MISS")
+	}
+
+	_, noCache := reqCC["no-cache"]
+	if maxAge, ok := reqCC["max-age"]; ok && maxAge == "0" {
+		noCache = true
+	}
+	if strings.Contains(strings.ToLower(req.Header.Get("pragma")), "no-cache") {
+		noCache = true
+	}
+
+	c.mu.Lock()
+	age := entry.age(time.Now())
+	freshFor, staleRevive, staleError := entry.freshFor, entry.staleRevive, entry.staleError
+	c.mu.Unlock()
+	if !noCache && age < freshFor {
+		return c.response(entry, req, "HIT")
+	}
+	if !noCache && age < freshFor+staleRevive {
+		// 先返回过期内容，后台重新验证
+		if c.markUpdating(entry) {
+			// 客户端请求结束后 context 会被取消，后台验证使用独立的超时
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(req.Context()), cacheRevalidateTimeout)
+			background := req.Clone(ctx)
+			go func() {
+				defer cancel()
+				c.revalidateInBackground(entry, background)
+			}()
+		}
+		return c.response(entry, req, "STALE")
+	}
+
+	res, err := c.transport.RoundTrip(c.conditionalRequest(req, entry))
+	if err != nil || res.StatusCode >= 500 {
+		if age < freshFor+staleError {
+			if res != nil {
+				res.Body.Close()
+			}
+			return c.response(entry, req, "STALE")
+		}
+		return withCacheStatus(res, "MISS"), err
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		c.refresh(entry, res)
+		return c.response(entry, req, "REVALIDATED")
+	}
+	c.remove(func(e *cacheEntry) bool { return e == entry })
+	return c.store(req, res, primary, "EXPIRED"), nil
+}
+
+func (c *httpCache) fetch(req *http.Request, primary string, status string) (*http.Response, error) {
+	res, err := c.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	return c.store(req, res, primary, status), nil
+}
+
+func (c *httpCache) revalidateInBackground(entry *cacheEntry, req *http.Request) {
+	defer func() {
+		c.mu.Lock()
+		entry.updating = false
+		c.mu.Unlock()
+	}()
+	res, err := c.transport.RoundTrip(c.conditionalRequest(req, entry))
+	if err != nil {
+		return
+	}
+	if res.StatusCode == http.StatusNotModified {
+		res.Body.Close()
+		c.refresh(entry, res)
+		return
+	}
+	res = c.store(req, res, entry.primary, "EXPIRED")
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+}
+
+func (c *httpCache) markUpdating(entry *cacheEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry.updating {
+		return false
+	}
+	entry.updating = true
+	return true
+}
+
+// 如果响应可以缓存，读取响应体的同时写入缓存，读完后保存
+func (c *httpCache) store(req *http.Request, res *http.Response, primary string, status string) *http.Response {
+	withCacheStatus(res, status)
+	entry := newCacheEntry(req, res)
+	if entry == nil || req.Method == http.MethodHead || res.ContentLength > c.maxSize/4 {
+		return res
+	}
+	varyNames := headerTokens(res.Header.Values("vary"))
+	entry.primary = primary
+	entry.key = primary + "\n" + varyKey(varyNames, req.Header)
+	body := &cacheBody{ReadCloser: res.Body, cache: c, entry: entry, vary: varyNames}
+	if c.dir != "" {
+		c.mu.Lock()
+		c.seq++
+		entry.file = filepath.Join(c.dir, fmt.Sprintf("%x-%d.cache", sha256.Sum256([]byte(entry.key)), c.seq))
+		c.mu.Unlock()
+		f, err := os.OpenFile(entry.file, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return res
+		}
+		body.file = f
+	}
+	res.Body = body
+	return res
+}
+
+func (c *httpCache) lookup(primary string, req *http.Request) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	varyNames, ok := c.vary[primary]
+	if !ok {
+		return nil
+	}
+	elem, ok := c.entries[primary+"\n"+varyKey(varyNames, req.Header)]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry)
+}
+
+func (c *httpCache) add(entry *cacheEntry, varyNames []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeElement(elem)
+	}
+	c.vary[entry.primary] = varyNames
+	c.variants[entry.primary]++
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += entry.size
+	for c.size > c.maxSize && c.lru.Len() > 0 {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+func (c *httpCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	if c.variants[entry.primary]--; c.variants[entry.primary] <= 0 {
+		delete(c.variants, entry.primary)
+		delete(c.vary, entry.primary)
+	}
+	c.size -= entry.size
+	if entry.file != "" {
+		os.Remove(entry.file)
+	}
+}
+
+func (c *httpCache) remove(match func(e *cacheEntry) bool) (count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if match(elem.Value.(*cacheEntry)) {
+			c.removeElement(elem)
+			count++
+		}
+		elem = next
+	}
+	return
+}
+
+// 根据 304 响应更新缓存的头部和有效期
+func (c *httpCache) refresh(entry *cacheEntry, res *http.Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range []string{"cache-control", "date", "etag", "expires", "last-modified", "vary"} {
+		if v := res.Header.Values(k); len(v) > 0 {
+			entry.header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
+	entry.responseAt = time.Now()
+	entry.initialAge = 0
+	entry.freshFor, entry.staleRevive, entry.staleError = freshness(entry.header, entry.responseAt)
+}
+
+func (c *httpCache) response(entry *cacheEntry, req *http.Request, status string) (*http.Response, error) {
+	c.mu.Lock()
+	header := entry.header.Clone()
+	age := entry.age(time.Now())
+	c.mu.Unlock()
+
+	var body io.ReadCloser = io.NopCloser(bytes.NewReader(entry.body))
+	if entry.file != "" {
+		f, err := os.Open(entry.file)
+		if err != nil {
+			c.remove(func(e *cacheEntry) bool { return e == entry })
+			return c.fetch(req, entry.primary, "MISS")
+		}
+		body = f
+	}
+	if req.Method == http.MethodHead {
+		body.Close()
+		body = http.NoBody
+	}
+	header.Set("age", strconv.Itoa(int(age.Seconds())))
+	header.Set("x-cache", status)
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", entry.status, http.StatusText(entry.status)),
+		StatusCode:    entry.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: entry.size,
+		Request:       req,
+	}, nil
+}
+
+func (e *cacheEntry) age(now time.Time) time.Duration {
+	return e.initialAge + now.Sub(e.responseAt)
+}
+
+type cacheBody struct {
+	io.ReadCloser
+	cache  *httpCache
+	entry  *cacheEntry
+	vary   []string
+	buf    bytes.Buffer
+	file   *os.File
+	failed bool
+	done   bool
+}
+
+func (b *cacheBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 && !b.failed {
+		b.entry.size += int64(n)
+		if b.entry.size > b.cache.maxSize/4 {
+			b.fail()
+		} else if b.file != nil {
+			if _, werr := b.file.Write(p[:n]); werr != nil {
+				b.fail()
+			}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.failed && !b.done {
+		b.done = true
+		if b.file != nil {
+			if b.file.Close() != nil {
+				b.failed = true
+				os.Remove(b.entry.file)
+			}
+			b.file = nil
+		} else {
+			b.entry.body = b.buf.Bytes()
+		}
+		if !b.failed {
+			b.cache.add(b.entry, b.vary)
+		}
+	}
+	return n, err
+}
+
+// 不再缓存这个响应，立即释放已经缓存的内容
+func (b *cacheBody) fail() {
+	b.failed = true
+	b.buf = bytes.Buffer{}
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.entry.file)
+		b.file = nil
+	}
+}
+
+func (b *cacheBody) Close() error {
+	if b.file != nil {
+		// 响应体没有读完，不保存
+		b.file.Close()
+		os.Remove(b.entry.file)
+		b.file = nil
+	}
+	return b.ReadCloser.Close()
+}
+
+func newCacheEntry(req *http.Request, res *http.Response) *cacheEntry {
+	switch res.StatusCode {
+	case 200, 203, 204, 300, 301, 308, 404, 410:
+	default:
+		return nil
+	}
+	cc := parseCacheControl(res.Header)
+	if _, ok := cc["no-store"]; ok {
+		return nil
+	}
+	if _, ok := cc["private"]; ok {
+		return nil
+	}
+	if res.Header.Get("set-cookie") != "" {
+		return nil
+	}
+	for _, name := range headerTokens(res.Header.Values("vary")) {
+		if name == "*" {
+			return nil
+		}
+	}
+	if req.Header.Get("authorization") != "" {
+		_, public := cc["public"]
+		_, shared := cc["s-maxage"]
+		if !public && !shared {
+			return nil
+		}
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		path:       originalRequest(req).URL.Path,
+		status:     res.StatusCode,
+		header:     res.Header.Clone(),
+		responseAt: now,
+	}
+	entry.header.Del("x-cache")
+	if age, err := strconv.Atoi(res.Header.Get("age")); err == nil && age > 0 {
+		entry.initialAge = time.Duration(age) * time.Second
+	}
+	entry.freshFor, entry.staleRevive, entry.staleError = freshness(res.Header, now)
+	hasValidator := res.Header.Get("etag") != "" || res.Header.Get("last-modified") != ""
+	if entry.freshFor <= 0 && !hasValidator && entry.staleRevive <= 0 && entry.staleError <= 0 {
+		return nil
+	}
+	return entry
+}
+
+// 计算缓存有效期，s-maxage 优先于 max-age，其次是 Expires
+func freshness(header http.Header, now time.Time) (fresh, staleRevive, staleError time.Duration) {
+	cc := parseCacheControl(header)
+	seconds := func(name string) (time.Duration, bool) {
+		v, ok := cc[name]
+		if !ok {
+			return 0, false
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, false
+		}
+		return time.Duration(n) * time.Second, true
+	}
+	staleRevive, _ = seconds("stale-while-revalidate")
+	staleError, _ = seconds("stale-if-error")
+	if _, ok := cc["no-cache"]; ok {
+		return 0, staleRevive, staleError
+	}
+	if d, ok := seconds("s-maxage"); ok {
+		return d, staleRevive, staleError
+	}
+	if d, ok := seconds("max-age"); ok {
+		return d, staleRevive, staleError
+	}
+	if expires := header.Get("expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil {
+			return 0, staleRevive, staleError
+		}
+		date, err := http.ParseTime(header.Get("date"))
+		if err != nil {
+			date = now
+		}
+		fresh = t.Sub(date)
+	}
+	return
+}
+
+func parseCacheControl(header http.Header) map[string]string {
+	cc := map[string]string{}
+	for _, v := range header.Values("cache-control") {
+		for _, directive := range strings.Split(v, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(directive, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func headerTokens(values []string) (tokens []string) {
+	for _, v := range values {
+		for _, token := range strings.Split(v, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				tokens = append(tokens, http.CanonicalHeaderKey(token))
+			}
+		}
+	}
+	sort.Strings(tokens)
+	return
+}
+
+func varyKey(names []string, header http.Header) string {
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(header.Values(name), ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func cachePrimaryKey(req *http.Request) string {
+	return req.URL.Scheme + "://" + req.Host + req.URL.RequestURI()
+}
+
+func (c *httpCache) conditionalRequest(req *http.Request, entry *cacheEntry) *http.Request {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	req = req.Clone(req.Context())
+	if etag := entry.header.Get("etag"); etag != "" {
+		req.Header.Set("if-none-match", etag)
+	}
+	if lastModified := entry.header.Get("last-modified"); lastModified != "" {
+		req.Header.Set("if-modified-since", lastModified)
+	}
+	return req
+}
+
+func withCacheStatus(res *http.Response, status string) *http.Response {
+	if res != nil {
+		res.Header.Set("x-cache", status)
+	}
+	return res
+}
+
+// 清除缓存，path 为空时清除全部，以 * 结尾时按前缀匹配
+func purgeCache(domain DomainConfig, w http.ResponseWriter, r *http.Request) {
+	if ip := net.ParseIP(remoteIP(r)); ip == nil || !ip.IsLoopback() {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete && r.Method != "PURGE" {
+		w.Header().Set("allow", "POST, DELETE, PURGE")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	path := r.URL.Query().Get("path")
+	match := func(e *cacheEntry) bool {
+		switch {
+		case path == "":
+			return true
+		case strings.HasSuffix(path, "*"):
+			return strings.HasPrefix(e.path, strings.TrimSuffix(path, "*"))
+		default:
+			return e.path == path
+		}
+	}
+	count := 0
+	if domain.Proxy != nil {
+		for i := range *domain.Proxy {
+			if cache := (*domain.Proxy)[i].cache; cache != nil {
+				count += cache.remove(match)
+			}
+		}
+	}
+	log.Printf("%s purge cache %q: %d\n", domain.label(), path, count)
+	w.Header().Set("content-type", "application/json")
+	fmt.Fprintf(w, "{\"purged\":%d}\n", count)
+}
@@ -0,0 +1,251 @@
+package static
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const caUsage = `Usage: serve ca <command> [--ca-dir dir] [--ca-cert file --ca-key file] [--ca-subject subject]
+    path                       Print the location of the root certificate and key
+    export [--format pem|der] [--out file]
+                               Export the root certificate, default pem to stdout
+    trust-install              Add the root certificate to the system trust store, usually needs root
+    rotate                     Regenerate the root certificate and key
+    inspect                    Show the root certificate and issued certificates
+    issue <domain> [name|ip...] [--cert file] [--key file]
+                               Issue a certificate to files, default <domain>.crt and <domain>.key,
+                               wildcard domains like *.example.com are supported`
+
+// serve ca 子命令，使用独立的 CA 实例，不影响正在运行的服务
+func RunCA(args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprintln(out, caUsage)
+		return nil
+	}
+	options := map[string]string{}
+	var params []string
+	for i := 1; i < len(args); i++ {
+		if strings.HasPrefix(args[i], "--") && i+1 < len(args) {
+			options[args[i]] = args[i+1]
+			i += 1
+		} else {
+			params = append(params, args[i])
+		}
+	}
+	c := &CA{
+		Dir:      options["--ca-dir"],
+		CertFile: options["--ca-cert"],
+		KeyFile:  options["--ca-key"],
+		Subject:  options["--ca-subject"],
+	}
+	switch args[0] {
+	case "path":
+		return c.printPath(out)
+	case "export":
+		return c.export(out, options["--format"], options["--out"])
+	case "trust-install":
+		return c.trustInstall(out)
+	case "rotate":
+		return c.rotate(out)
+	case "inspect":
+		return c.inspect(out)
+	case "issue":
+		if len(params) == 0 {
+			return errors.New("missing domain, usage: serve ca issue <domain>")
+		}
+		return c.issueToFiles(out, params, options["--cert"], options["--key"])
+	case "help", "-h", "--help":
+		fmt.Fprintln(out, caUsage)
+		return nil
+	}
+	return fmt.Errorf("unknown ca command %s\n%s", args[0], caUsage)
+}
+
+func (ca *CA) printPath(out io.Writer) error {
+	certFile, keyFile, err := ca.rootFiles()
+	if err != nil {
+		return err
+	}
+	dir, err := ca.getRootDir()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Dir: \t%s\n", dir)
+	fmt.Fprintf(out, "Cert: \t%s\n", certFile)
+	fmt.Fprintf(out, "Key: \t%s\n", keyFile)
+	return nil
+}
+
+func (ca *CA) export(out io.Writer, format string, file string) error {
+	if err := ca.generateRootCertificate(); err != nil {
+		return err
+	}
+	content := ca.certByte
+	switch format {
+	case "", "pem":
+	case "der":
+		block, _ := pem.Decode(ca.certByte)
+		if block == nil {
+			return errors.New("invalid root certificate")
+		}
+		content = block.Bytes
+	default:
+		return fmt.Errorf("unknown format %s, use pem or der", format)
+	}
+	if file == "" {
+		_, err := out.Write(content)
+		return err
+	}
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Root certificate exported to %s\n", file)
+	return nil
+}
+
+// 重新生成根证书，之前签发的证书全部作废，需要重新信任新的根证书
+func (ca *CA) rotate(out io.Writer) error {
+	if ca.CertFile != "" {
+		return errors.New("the ca is provided by --ca-cert, rotate it yourself")
+	}
+	certFile, keyFile, err := ca.rootFiles()
+	if err != nil {
+		return err
+	}
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if dir, err := ca.issuedDir(); err == nil {
+		os.RemoveAll(dir)
+	}
+	ca.certByte, ca.keyByte = nil, nil
+	if err := ca.generateRootCertificate(); err != nil {
+		return err
+	}
+	cert, err := ca.rootCertificate()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Root certificate regenerated: %s\n", certFile)
+	fmt.Fprintf(out, "SHA-256: \t%s\n", fingerprint(cert))
+	fmt.Fprintln(out, "Trust the new root certificate and restart running servers")
+	return nil
+}
+
+func (ca *CA) inspect(out io.Writer) error {
+	if err := ca.generateRootCertificate(); err != nil {
+		return err
+	}
+	cert, err := ca.rootCertificate()
+	if err != nil {
+		return err
+	}
+	certFile, _, _ := ca.rootFiles()
+	fmt.Fprintf(out, "Root: \t%s\n", certFile)
+	printCertificate(out, cert)
+
+	dir, err := ca.issuedDir()
+	if err != nil {
+		return err
+	}
+	files, _ := filepath.Glob(path.Join(dir, "*.crt"))
+	sort.Strings(files)
+	fmt.Fprintf(out, "Issued: \t%d\n", len(files))
+	for _, file := range files {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		block, _ := pem.Decode(content)
+		if block == nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		fmt.Fprintf(out, "%s: \t%s\n", strings.TrimSuffix(filepath.Base(file), ".crt"), file)
+		printCertificate(out, leaf)
+	}
+	return nil
+}
+
+func (ca *CA) issueToFiles(out io.Writer, params []string, certFile string, keyFile string) error {
+	if err := ca.generateRootCertificate(); err != nil {
+		return err
+	}
+	var names []string
+	var ips []net.IP
+	for _, param := range params {
+		if ip := net.ParseIP(param); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			names = append(names, param)
+		}
+	}
+	if len(names) == 0 {
+		return errors.New("missing domain, usage: serve ca issue <domain>")
+	}
+	domain := strings.ReplaceAll(names[0], "*", "_wildcard")
+	if certFile == "" {
+		certFile = domain + ".crt"
+	}
+	if keyFile == "" {
+		keyFile = domain + ".key"
+	}
+	certPEM, keyPEM, err := ca.createLeafCertificate(names, ips)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return err
+	}
+	ca.saveIssued(names[0], certPEM, nil)
+	fmt.Fprintf(out, "Cert: \t%s\n", certFile)
+	fmt.Fprintf(out, "Key: \t%s\n", keyFile)
+	return nil
+}
+
+func (ca *CA) rootCertificate() (*x509.Certificate, error) {
+	block, _ := pem.Decode(ca.certByte)
+	if block == nil {
+		return nil, errors.New("invalid root certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func printCertificate(out io.Writer, cert *x509.Certificate) {
+	fmt.Fprintf(out, "\tSubject: \t%s\n", cert.Subject)
+	fmt.Fprintf(out, "\tSerial: \t%x\n", cert.SerialNumber)
+	fmt.Fprintf(out, "\tNot Before: \t%s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(out, "\tNot After: \t%s\n", cert.NotAfter.Format(time.RFC3339))
+	if sans := certificateSANs(cert); len(sans) > 0 {
+		fmt.Fprintf(out, "\tSANs: \t%s\n", strings.Join(sans, ", "))
+	}
+	fmt.Fprintf(out, "\tSHA-256: \t%s\n", fingerprint(cert))
+}
+
+func fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hex := make([]string, len(sum))
+	for i, b := range sum {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hex, ":")
+}
@@ -0,0 +1,79 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// Linux 各发行版的系统信任目录和更新命令
+var linuxTrustStores = []struct {
+	dir     string
+	file    string
+	command []string
+}{
+	// Debian、Ubuntu、Alpine
+	{"/usr/local/share/ca-certificates", "mini-http-root.crt", []string{"update-ca-certificates"}},
+	// Fedora、RHEL、CentOS
+	{"/etc/pki/ca-trust/source/anchors", "mini-http-root.pem", []string{"update-ca-trust", "extract"}},
+	// Arch
+	{"/etc/ca-certificates/trust-source/anchors", "mini-http-root.crt", []string{"trust", "extract-compat"}},
+	// openSUSE
+	{"/etc/pki/trust/anchors", "mini-http-root.pem", []string{"update-ca-certificates"}},
+}
+
+// 把根证书加入系统信任，通常需要 root 或管理员权限；
+// Firefox 和 Java 使用自己的证书库，需要另外导入
+func (ca *CA) trustInstall(out io.Writer) error {
+	if err := ca.generateRootCertificate(); err != nil {
+		return err
+	}
+	certFile, _, err := ca.rootFiles()
+	if err != nil {
+		return err
+	}
+	var command []string
+	switch runtime.GOOS {
+	case "linux":
+		for _, store := range linuxTrustStores {
+			if info, err := os.Stat(store.dir); err != nil || !info.IsDir() {
+				continue
+			}
+			if _, err := exec.LookPath(store.command[0]); err != nil {
+				continue
+			}
+			file := filepath.Join(store.dir, store.file)
+			if err := os.WriteFile(file, ca.certByte, 0644); err != nil {
+				return err
+			}
+			fmt.Fprintf(out, "Root certificate copied to %s\n", file)
+			command = store.command
+			break
+		}
+		if command == nil {
+			return errors.New("no supported system trust store found, export the root certificate and trust it manually")
+		}
+	case "darwin":
+		command = []string{"security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", "/Library/Keychains/System.keychain", certFile}
+	case "windows":
+		command = []string{"certutil", "-addstore", "-f", "ROOT", certFile}
+	default:
+		return fmt.Errorf("trust-install is not supported on %s, export the root certificate and trust it manually", runtime.GOOS)
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, out, out
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", command[0], err)
+	}
+	cert, err := ca.rootCertificate()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Root certificate trusted: %s\n", certFile)
+	fmt.Fprintf(out, "SHA-256: \t%s\n", fingerprint(cert))
+	return nil
+}
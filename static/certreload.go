@@ -0,0 +1,138 @@
+package static
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultCertReloadInterval = time.Minute
+
+// 定期检查 --cert/--key 文件的修改时间，文件更新后校验新证书再替换，
+// 新证书无效时继续使用旧证书，直到文件再次变化
+type certReloader struct {
+	domain DomainConfig
+	stamp  string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	err  error
+
+	ocsp *ocspStapler
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+func newCertReloader(domain DomainConfig, interval time.Duration) *certReloader {
+	c := &certReloader{domain: domain, done: make(chan struct{})}
+	if !domain.DisableOCSP {
+		c.ocsp = &ocspStapler{changed: make(chan struct{}, 1)}
+		go c.stapleOCSP()
+	}
+	c.reload()
+	if interval > 0 {
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					c.reload()
+				case <-c.done:
+					return
+				}
+			}
+		}()
+	}
+	return c
+}
+
+// 停止定期检查和 OCSP 更新，服务关闭时调用
+func (c *certReloader) stop() {
+	c.stopOnce.Do(func() { close(c.done) })
+}
+
+func (c *certReloader) getCertificate() (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert == nil {
+		return nil, c.err
+	}
+	return c.cert, nil
+}
+
+func (c *certReloader) reload() {
+	stamp, err := c.fileStamp()
+	if err != nil {
+		// 证书轮换过程中文件可能暂时不存在，已有证书时忽略
+		c.fail(err, false)
+		return
+	}
+	if stamp == c.stamp {
+		return
+	}
+	c.stamp = stamp
+
+	cert, err := c.domain.loadCertificate()
+	if err == nil {
+		err = validateCertificate(cert)
+	}
+	if err != nil {
+		c.fail(err, true)
+		return
+	}
+	c.mu.Lock()
+	c.cert, c.err = cert, nil
+	c.mu.Unlock()
+	if c.ocsp != nil {
+		select {
+		case c.ocsp.changed <- struct{}{}:
+		default:
+		}
+	}
+	log.Printf("%s certificate loaded from %s, expires at %s", c.domain.label(), c.domain.Cert, cert.Leaf.NotAfter.Format(time.RFC3339))
+}
+
+func (c *certReloader) fail(err error, report bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == nil {
+		if c.err != nil && c.err.Error() == err.Error() {
+			return
+		}
+		c.err = err
+		log.Printf("%s certificate %s: %v", c.domain.label(), c.domain.Cert, err)
+	} else if report {
+		log.Printf("%s certificate %s: %v, keep serving the previous one", c.domain.label(), c.domain.Cert, err)
+	}
+}
+
+// 文件的修改时间和大小，任意一个变化都重新加载
+func (c *certReloader) fileStamp() (string, error) {
+	stamp := ""
+	for _, file := range []string{c.domain.Cert, c.domain.Key} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%d:%d;", info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
+
+func validateCertificate(cert *tls.Certificate) (err error) {
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+	if time.Now().After(cert.Leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
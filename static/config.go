@@ -2,8 +2,11 @@ package static
 
 import (
 	"fmt"
+	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type ServerConfig struct {
@@ -11,10 +14,40 @@ type ServerConfig struct {
 	HTTPSPort     int
 	Domains       []DomainConfig
 	DefaultDomain DomainConfig
+	ACMEEmail     string
+	ACMEDirectory string
+	ACMEDir       string
+	ACMECA        string
+	CADir         string
+	CACert        string
+	CAKey         string
+	CASubject     string
+
+	CertReloadInterval time.Duration
+	DisableHTTP2       bool
+	H2C                bool
+	HTTP3              bool
+	HTTP3UDPBuffer     int64
+
+	Listens         []ListenConfig
+	ProxyProtocol   []string
+	ShutdownTimeout time.Duration
+	TrustedProxies  []string
+	RealIPHeader    string
+
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int64
+	MaxConnections    int
+
+	trustedProxies []*net.IPNet
 }
 
 func (c *ServerConfig) ParseFromArgs(args []string) {
 	var domain = NewDomain()
+	var portSet bool
 	for i := 0; i < len(args); i++ {
 		if i+1 <= len(args) {
 			var key = args[i]
@@ -28,6 +61,9 @@ func (c *ServerConfig) ParseFromArgs(args []string) {
 				domain = NewDomain()
 				domain.Domain = args[i+1]
 				i += 1
+			case key == "--alias":
+				domain.Aliases = append(domain.Aliases, args[i+1])
+				i += 1
 			case key == "--cert":
 				domain.Cert = args[i+1]
 				i += 1
@@ -50,12 +86,256 @@ func (c *ServerConfig) ParseFromArgs(args []string) {
 				proxy := append(*domain.Proxy, c.parseDomainProxy(args[i+1]))
 				domain.Proxy = &proxy
 				i += 1
+			case key == "--ws-handshake-timeout":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.WSHandshakeTimeout, _ = time.ParseDuration(args[i+1])
+				}
+				i += 1
+			case key == "--ws-idle-timeout":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.WSIdleTimeout, _ = time.ParseDuration(args[i+1])
+				}
+				i += 1
+			case key == "--proxy-buffering":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.DisableBuffering = args[i+1] == "off"
+				}
+				i += 1
+			case key == "--proxy-max-body":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.MaxBodySize, _ = parseSize(args[i+1])
+				}
+				i += 1
+			case key == "--proxy-cache":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.CacheSize, _ = parseSize(args[i+1])
+				}
+				i += 1
+			case key == "--proxy-cache-dir":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.CacheDir = args[i+1]
+				}
+				i += 1
+			case key == "--proxy-mirror":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.Mirror = args[i+1]
+					proxy.MirrorPercent = 100
+				}
+				i += 1
+			case key == "--proxy-mirror-percent":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.MirrorPercent, _ = strconv.ParseFloat(strings.TrimSuffix(args[i+1], "%"), 64)
+				}
+				i += 1
+			case key == "--proxy-mirror-timeout":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.MirrorTimeout, _ = time.ParseDuration(args[i+1])
+				}
+				i += 1
+			case key == "--proxy-mirror-max-body":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.MirrorMaxBody, _ = parseSize(args[i+1])
+				}
+				i += 1
+			case key == "--proxy-fallback":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.Fallback = args[i+1]
+				}
+				i += 1
+			case key == "--proxy-fallback-code":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.FallbackCode, _ = strconv.Atoi(args[i+1])
+				}
+				i += 1
+			case key == "--proxy-fallback-on":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.FallbackOn = nil
+					for _, v := range strings.Split(args[i+1], ",") {
+						if code, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+							proxy.FallbackOn = append(proxy.FallbackOn, code)
+						}
+					}
+				}
+				i += 1
+			case key == "--proxy-record":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.Record = args[i+1]
+				}
+				i += 1
+			case key == "--proxy-record-redact":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.RecordRedact = strings.Split(args[i+1], ",")
+				}
+				i += 1
+			case key == "--proxy-replay":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.Replay = args[i+1]
+				}
+				i += 1
+			case key == "--proxy-replay-match-body":
+				if proxy := domain.lastProxy(); proxy != nil {
+					proxy.ReplayMatchBody = args[i+1] == "on"
+				}
+				i += 1
+			case key == "--cache-purge":
+				domain.CachePurge = args[i+1]
+				i += 1
+			case key == "--mock":
+				if domain.Mock == nil {
+					m := make([]DomainMock, 0)
+					domain.Mock = &m
+				}
+				proxy := c.parseDomainProxy(args[i+1])
+				mock := append(*domain.Mock, DomainMock{Url: proxy.Url, Dir: proxy.Proxy})
+				domain.Mock = &mock
+				i += 1
+			case key == "--mock-delay":
+				if domain.Mock != nil && len(*domain.Mock) > 0 {
+					(*domain.Mock)[len(*domain.Mock)-1].Delay, _ = time.ParseDuration(args[i+1])
+				}
+				i += 1
+			case key == "--force-https":
+				// on 和 301 使用 301，308 会保留请求方法和请求体
+				switch args[i+1] {
+				case "on", "301":
+					domain.ForceHTTPS = http.StatusMovedPermanently
+				case "308":
+					domain.ForceHTTPS = http.StatusPermanentRedirect
+				default:
+					domain.ForceHTTPS = 0
+				}
+				i += 1
+			case key == "--hsts-max-age":
+				maxAge, _ := strconv.Atoi(args[i+1])
+				domain.HSTSMaxAge = maxAge
+				i += 1
+			case key == "--hsts-include-subdomains":
+				domain.HSTSSubdomain = args[i+1] == "on"
+				i += 1
+			case key == "--hsts-preload":
+				domain.HSTSPreload = args[i+1] == "on"
+				i += 1
+			case key == "--ocsp-stapling":
+				domain.DisableOCSP = args[i+1] == "off"
+				i += 1
+			case key == "--client-ca":
+				domain.ClientCA = args[i+1]
+				i += 1
+			case key == "--client-auth":
+				domain.ClientAuth = args[i+1]
+				i += 1
+			case key == "--tls-preset":
+				domain.TLSPreset = args[i+1]
+				i += 1
+			case key == "--tls-min-version":
+				domain.TLSMinVersion = args[i+1]
+				i += 1
+			case key == "--tls-max-version":
+				domain.TLSMaxVersion = args[i+1]
+				i += 1
+			case key == "--tls-ciphers":
+				domain.TLSCiphers = strings.Split(args[i+1], ",")
+				i += 1
+			case key == "--tls-curves":
+				domain.TLSCurves = strings.Split(args[i+1], ",")
+				i += 1
+			case key == "--http2":
+				c.DisableHTTP2 = args[i+1] == "off"
+				i += 1
+			case key == "--h2c":
+				c.H2C = args[i+1] == "on"
+				i += 1
+			case key == "--http3":
+				c.HTTP3 = args[i+1] == "on"
+				i += 1
+			case key == "--http3-udp-buffer":
+				c.HTTP3UDPBuffer, _ = parseSize(args[i+1])
+				i += 1
+			case key == "--ca-dir":
+				c.CADir = args[i+1]
+				i += 1
+			case key == "--ca-cert":
+				c.CACert = args[i+1]
+				i += 1
+			case key == "--ca-key":
+				c.CAKey = args[i+1]
+				i += 1
+			case key == "--ca-subject":
+				c.CASubject = args[i+1]
+				i += 1
+			case key == "--shutdown-timeout":
+				c.ShutdownTimeout, _ = time.ParseDuration(args[i+1])
+				i += 1
+			case key == "--cert-reload-interval":
+				c.CertReloadInterval, _ = time.ParseDuration(args[i+1])
+				i += 1
+			case key == "--acme":
+				domain.ACME = args[i+1] == "on"
+				i += 1
+			case key == "--acme-email":
+				c.ACMEEmail = args[i+1]
+				i += 1
+			case key == "--acme-directory":
+				c.ACMEDirectory = args[i+1]
+				i += 1
+			case key == "--acme-dir":
+				c.ACMEDir = args[i+1]
+				i += 1
+			case key == "--acme-ca":
+				c.ACMECA = args[i+1]
+				i += 1
 			case key == "--not-found":
 				domain.NotFound = args[i+1]
 				i += 1
 			case key == "--port":
 				port, _ := strconv.ParseInt(args[i+1], 0, strconv.IntSize)
 				c.HTTPPort = int(port)
+				portSet = true
+				i += 1
+			case key == "--listen":
+				c.Listens = append(c.Listens, ListenConfig{Address: args[i+1], Protocol: "http"})
+				i += 1
+			case key == "--listen-protocol":
+				if listen := c.lastListen(); listen != nil {
+					listen.Protocol = args[i+1]
+				}
+				i += 1
+			case key == "--read-header-timeout":
+				c.ReadHeaderTimeout, _ = time.ParseDuration(args[i+1])
+				i += 1
+			case key == "--read-timeout":
+				c.ReadTimeout, _ = time.ParseDuration(args[i+1])
+				i += 1
+			case key == "--write-timeout":
+				c.WriteTimeout, _ = time.ParseDuration(args[i+1])
+				i += 1
+			case key == "--idle-timeout":
+				c.IdleTimeout, _ = time.ParseDuration(args[i+1])
+				i += 1
+			case key == "--max-header-bytes":
+				c.MaxHeaderBytes, _ = parseSize(args[i+1])
+				i += 1
+			case key == "--max-connections":
+				c.MaxConnections, _ = strconv.Atoi(args[i+1])
+				i += 1
+			case key == "--trusted-proxies":
+				c.TrustedProxies = strings.Split(args[i+1], ",")
+				i += 1
+			case key == "--real-ip-header":
+				c.RealIPHeader = args[i+1]
+				i += 1
+			case key == "--accept-proxy-protocol":
+				c.ProxyProtocol = strings.Split(args[i+1], ",")
+				i += 1
+			case key == "--listen-proxy-protocol":
+				if listen := c.lastListen(); listen != nil {
+					listen.ProxyProtocol = strings.Split(args[i+1], ",")
+				}
+				i += 1
+			case key == "--listen-domain":
+				if listen := c.lastListen(); listen != nil {
+					listen.Domains = append(listen.Domains, strings.Split(args[i+1], ",")...)
+				}
 				i += 1
 			case key == "--https-port":
 				port, _ := strconv.ParseInt(args[i+1], 0, strconv.IntSize)
@@ -69,6 +349,10 @@ func (c *ServerConfig) ParseFromArgs(args []string) {
 	} else {
 		c.DefaultDomain = domain
 	}
+	// 使用 --listen 或 systemd 传入 socket 时不再默认监听 80 端口
+	if (len(c.Listens) > 0 || socketActivated()) && !portSet {
+		c.HTTPPort = 0
+	}
 }
 
 func (c *ServerConfig) parseDomainProxy(cmd string) DomainProxy {
@@ -76,9 +360,60 @@ func (c *ServerConfig) parseDomainProxy(cmd string) DomainProxy {
 	return DomainProxy{Url: cmd[0:index], Proxy: cmd[index+1:]}
 }
 
+// 解析 1024、512k、10m、1g 这样的大小
+func parseSize(size string) (int64, error) {
+	size = strings.ToLower(strings.TrimSpace(size))
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(size, "k"):
+		unit = 1 << 10
+	case strings.HasSuffix(size, "m"):
+		unit = 1 << 20
+	case strings.HasSuffix(size, "g"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		size = size[:len(size)-1]
+	}
+	n, err := strconv.ParseInt(size, 10, 64)
+	return n * unit, err
+}
+
 func (c *ServerConfig) PrintConfig() {
 	// 将所有domains以表格形式输出到控制台
 	fmt.Println("Static Server Configuration:")
+	if c.ACMEDirectory != "" {
+		fmt.Printf("ACME: \t%s\n", c.ACMEDirectory)
+	}
+	if c.CACert != "" {
+		fmt.Printf("CA: \t%s\n", c.CACert)
+	} else if c.CADir != "" {
+		fmt.Printf("CA: \t%s\n", c.CADir)
+	}
+	if c.DisableHTTP2 {
+		fmt.Printf("HTTP/2: \toff\n")
+	}
+	if c.H2C {
+		fmt.Printf("H2C: \ton\n")
+	}
+	if c.HTTP3 {
+		fmt.Printf("HTTP/3: \ton\n")
+	}
+	if c.ReadTimeout > 0 || c.WriteTimeout > 0 {
+		fmt.Printf("Timeouts: \tread %s, write %s\n", c.ReadTimeout, c.WriteTimeout)
+	}
+	if c.MaxConnections > 0 {
+		fmt.Printf("Max Connections: \t%d\n", c.MaxConnections)
+	}
+	if len(c.TrustedProxies) > 0 {
+		fmt.Printf("Trusted Proxies: \t%s (%s)\n", strings.Join(c.TrustedProxies, ", "), c.RealIPHeader)
+	}
+	if len(c.ProxyProtocol) > 0 {
+		fmt.Printf("Proxy Protocol: \t%s\n", strings.Join(c.ProxyProtocol, ", "))
+	}
+	for _, listen := range c.Listens {
+		listen.print()
+	}
 	c.DefaultDomain.print()
 	for _, domain := range c.Domains {
 		domain.print()
@@ -87,16 +422,37 @@ func (c *ServerConfig) PrintConfig() {
 }
 
 func (s *ServerConfig) CurrentDomain(host string) (domain DomainConfig) {
-	hostInfos := strings.Split(host, ":")
+	domain, _ = s.matchDomain(host)
+	return domain
+}
+
+// 依次按域名、别名、通配符域名匹配，没有匹配时返回第一个域名
+func (s *ServerConfig) matchDomain(host string) (domain DomainConfig, matched bool) {
+	host = hostname(host)
 	domain = s.DefaultDomain
 	if len(s.Domains) > 0 {
 		domain = s.Domains[0]
 	}
 	for i := 0; i < len(s.Domains); i++ {
-		if (s.Domains)[i].Domain == hostInfos[0] {
-			domain = s.Domains[i]
-			return
+		if (s.Domains)[i].hasName(host) {
+			return s.Domains[i], true
 		}
 	}
-	return domain
+	for i := 0; i < len(s.Domains); i++ {
+		for _, name := range s.Domains[i].names() {
+			if matchWildcard(name, host) {
+				return s.Domains[i], true
+			}
+		}
+	}
+	return domain, false
+}
+
+// *.example.com 只匹配一级子域名
+func matchWildcard(pattern string, host string) bool {
+	if !strings.HasPrefix(pattern, "*.") || !strings.HasSuffix(host, pattern[1:]) {
+		return false
+	}
+	label := strings.TrimSuffix(host, pattern[1:])
+	return label != "" && !strings.Contains(label, ".")
 }
@@ -4,22 +4,61 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http/httputil"
+	"strings"
+	"time"
 )
 
 type DomainProxy struct {
-	Url      string
-	Proxy    string
-	Instance *httputil.ReverseProxy
+	Url                string
+	Proxy              string
+	WSHandshakeTimeout time.Duration
+	WSIdleTimeout      time.Duration
+	DisableBuffering   bool
+	MaxBodySize        int64
+	CacheSize          int64
+	CacheDir           string
+	Mirror             string
+	MirrorPercent      float64
+	MirrorTimeout      time.Duration
+	MirrorMaxBody      int64
+	Fallback           string
+	FallbackCode       int
+	FallbackOn         []int
+	Record             string
+	RecordRedact       []string
+	Replay             string
+	ReplayMatchBody    bool
+	Instance           *httputil.ReverseProxy
+	WebSocket          *httputil.ReverseProxy
+	cache              *httpCache
+	replayer           *harReplayer
+	recorder           *harRecorder
 }
 
 type DomainConfig struct {
-	Domain   string
-	Cert     string
-	Key      string
-	Mode     string
-	Root     string
-	NotFound string
-	Proxy    *[]DomainProxy
+	Domain        string
+	Aliases       []string
+	Cert          string
+	Key           string
+	DisableOCSP   bool
+	ACME          bool
+	ForceHTTPS    int
+	HSTSMaxAge    int
+	HSTSSubdomain bool
+	HSTSPreload   bool
+	ClientCA      string
+	ClientAuth    string
+	TLSPreset     string
+	TLSMinVersion string
+	TLSMaxVersion string
+	TLSCiphers    []string
+	TLSCurves     []string
+	Mode          string
+	Root          string
+	NotFound      string
+	CachePurge    string
+	Proxy         *[]DomainProxy
+	Mock          *[]DomainMock
 }
 
 func NewDomain() (domain DomainConfig) {
@@ -38,6 +77,30 @@ func (d *DomainConfig) label() (label string) {
 	return
 }
 
+func (d *DomainConfig) names() []string {
+	return append([]string{d.Domain}, d.Aliases...)
+}
+
+func (d *DomainConfig) hasName(host string) bool {
+	for _, name := range d.names() {
+		if name == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DomainConfig) hstsHeader() string {
+	header := fmt.Sprintf("max-age=%d", d.HSTSMaxAge)
+	if d.HSTSSubdomain {
+		header += "; includeSubDomains"
+	}
+	if d.HSTSPreload {
+		header += "; preload"
+	}
+	return header
+}
+
 func (d *DomainConfig) isEmpty() (empty bool) {
 	empty = true
 	if d.Domain != "" {
@@ -49,6 +112,9 @@ func (d *DomainConfig) isEmpty() (empty bool) {
 func (d *DomainConfig) print() {
 	fmt.Printf("%s: \t%s\n", d.label(), d.Root)
 	fmt.Printf("\t404: \t%s\n", d.NotFound)
+	if len(d.Aliases) > 0 {
+		fmt.Printf("\tAlias: \t%s\n", strings.Join(d.Aliases, ","))
+	}
 	if d.Mode != "" {
 		fmt.Printf("\tMode: \t%s\n", d.Mode)
 	}
@@ -58,9 +124,71 @@ func (d *DomainConfig) print() {
 	if d.Key != "" {
 		fmt.Printf("\tKey: \t%s\n", d.Key)
 	}
+	if d.ForceHTTPS != 0 {
+		fmt.Printf("\tForce HTTPS: \t%d\n", d.ForceHTTPS)
+	}
+	if d.HSTSMaxAge > 0 {
+		fmt.Printf("\tHSTS: \t%s\n", d.hstsHeader())
+	}
+	if d.DisableOCSP {
+		fmt.Printf("\tOCSP Stapling: \toff\n")
+	}
+	if d.ACME {
+		fmt.Printf("\tACME: \ton\n")
+	}
+	if d.TLSPreset != "" || d.TLSMinVersion != "" || d.TLSMaxVersion != "" {
+		fmt.Printf("\tTLS: \t%s %s-%s\n", d.TLSPreset, d.TLSMinVersion, d.TLSMaxVersion)
+	}
+	if d.TLSCiphers != nil {
+		fmt.Printf("\t\tCiphers: \t%s\n", strings.Join(d.TLSCiphers, ","))
+	}
+	if d.TLSCurves != nil {
+		fmt.Printf("\t\tCurves: \t%s\n", strings.Join(d.TLSCurves, ","))
+	}
+	if d.ClientCA != "" || d.ClientAuth != "" {
+		fmt.Printf("\tClient Auth: \t%s %s\n", d.ClientAuth, d.ClientCA)
+	}
+	if d.CachePurge != "" {
+		fmt.Printf("\tCache Purge: \t%s\n", d.CachePurge)
+	}
+	if d.Mock != nil {
+		for _, mock := range *d.Mock {
+			fmt.Printf("\tMock: \t%s -> %s\n", mock.Url, mock.Dir)
+			if mock.Delay > 0 {
+				fmt.Printf("\t\tDelay: \t%s\n", mock.Delay)
+			}
+		}
+	}
 	if d.Proxy != nil {
 		for _, proxy := range *d.Proxy {
 			fmt.Printf("\tProxy: \t%s -> %s\n", proxy.Url, proxy.Proxy)
+			if proxy.WSHandshakeTimeout > 0 {
+				fmt.Printf("\t\tWebSocket Handshake Timeout: %s\n", proxy.WSHandshakeTimeout)
+			}
+			if proxy.WSIdleTimeout != 0 {
+				fmt.Printf("\t\tWebSocket Idle Timeout: %s\n", proxy.WSIdleTimeout)
+			}
+			if proxy.DisableBuffering {
+				fmt.Printf("\t\tBuffering: \toff\n")
+			}
+			if proxy.MaxBodySize > 0 {
+				fmt.Printf("\t\tMax Body Size: \t%d\n", proxy.MaxBodySize)
+			}
+			if proxy.Mirror != "" {
+				fmt.Printf("\t\tMirror: \t%s %g%%\n", proxy.Mirror, proxy.MirrorPercent)
+			}
+			if proxy.Fallback != "" {
+				fmt.Printf("\t\tFallback: \t%s %v\n", proxy.Fallback, proxy.FallbackOn)
+			}
+			if proxy.Record != "" {
+				fmt.Printf("\t\tRecord: \t%s\n", proxy.Record)
+			}
+			if proxy.Replay != "" {
+				fmt.Printf("\t\tReplay: \t%s\n", proxy.Replay)
+			}
+			if proxy.CacheSize > 0 || proxy.CacheDir != "" {
+				fmt.Printf("\t\tCache: \t%d %s\n", proxy.CacheSize, proxy.CacheDir)
+			}
 		}
 	}
 }
@@ -72,3 +200,11 @@ func (d *DomainConfig) loadCertificate() (*tls.Certificate, error) {
 	}
 	return &cert, err
 }
+
+// 返回最近一个 --proxy 配置，后续的代理参数作用于它
+func (d *DomainConfig) lastProxy() *DomainProxy {
+	if d.Proxy == nil || len(*d.Proxy) == 0 {
+		return nil
+	}
+	return &(*d.Proxy)[len(*d.Proxy)-1]
+}
@@ -0,0 +1,54 @@
+package static
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+const defaultFallbackCode = http.StatusServiceUnavailable
+
+var errFallbackStatus = errors.New("upstream status triggers fallback")
+
+// 后端返回 FallbackOn 中的状态码时，转给 ErrorHandler 处理
+func (p *DomainProxy) checkFallbackStatus(res *http.Response) error {
+	if p.Fallback == "" {
+		return nil
+	}
+	for _, code := range p.FallbackOn {
+		if res.StatusCode == code {
+			res.Body.Close()
+			return fmt.Errorf("%w: %d", errFallbackStatus, code)
+		}
+	}
+	return nil
+}
+
+// Fallback 支持三种形式：
+// static 继续按静态资源处理；json:{...} 返回固定的 JSON；/maintenance.html 返回 root 目录下的文件
+func (p *DomainProxy) serveFallback(domain DomainConfig, w http.ResponseWriter, r *http.Request) {
+	code := p.FallbackCode
+	if code == 0 {
+		code = defaultFallbackCode
+	}
+	switch {
+	case p.Fallback == "static":
+		serveStatic(domain, w, r)
+	case strings.HasPrefix(p.Fallback, "json:"):
+		w.Header().Set("content-type", "application/json")
+		w.Header().Set("cache-control", "no-store")
+		w.WriteHeader(code)
+		io.WriteString(w, strings.TrimPrefix(p.Fallback, "json:"))
+	default:
+		file := path.Join(domain.Root, p.Fallback)
+		if contentType := mime.TypeByExtension(path.Ext(file)); contentType != "" {
+			w.Header().Set("content-type", contentType)
+		}
+		w.Header().Set("cache-control", "no-store")
+		sendFile(&w, file, code)
+	}
+}
@@ -0,0 +1,340 @@
+package static
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGI 协议中用到的记录类型，参考 https://fastcgi-archives.github.io/FastCGI_Specification.html
+const (
+	fcgiBeginRequest uint8 = 1
+	fcgiEndRequest   uint8 = 3
+	fcgiParams       uint8 = 4
+	fcgiStdin        uint8 = 5
+	fcgiStdout       uint8 = 6
+	fcgiStderr       uint8 = 7
+
+	fcgiResponder    = 1
+	fcgiMaxWrite     = 65535
+	fcgiDialTimeout  = 10 * time.Second
+	fcgiDefaultIndex = "index.php"
+)
+
+// 解析 fastcgi://host:port 和 fastcgi+unix:///run/php-fpm.sock 形式的代理目标
+func (p *DomainProxy) fastCGIAddress() (network string, address string, ok bool) {
+	target, err := url.Parse(p.Proxy)
+	if err != nil {
+		return
+	}
+	switch target.Scheme {
+	case "fastcgi":
+		return "tcp", target.Host, true
+	case "fastcgi+unix":
+		return "unix", target.Path, true
+	}
+	return
+}
+
+type fcgiConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	buf  [8]byte
+}
+
+func (c *fcgiConn) writeRecord(recType uint8, content []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	padding := uint8(-len(content) & 7)
+	c.buf = [8]byte{1, recType, 0, 1}
+	binary.BigEndian.PutUint16(c.buf[4:], uint16(len(content)))
+	c.buf[6] = padding
+	if _, err := c.conn.Write(c.buf[:]); err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(content); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(make([]byte, padding))
+	return err
+}
+
+// 按协议把数据切成多条记录写入，最后写一条空记录表示流结束
+func (c *fcgiConn) writeStream(recType uint8, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fcgiMaxWrite {
+			n = fcgiMaxWrite
+		}
+		if err := c.writeRecord(recType, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return c.writeRecord(recType, nil)
+}
+
+func (c *fcgiConn) writeParams(params map[string]string) error {
+	var buf []byte
+	for k, v := range params {
+		buf = appendFCGILength(buf, len(k))
+		buf = appendFCGILength(buf, len(v))
+		buf = append(buf, k...)
+		buf = append(buf, v...)
+	}
+	return c.writeStream(fcgiParams, buf)
+}
+
+func appendFCGILength(buf []byte, n int) []byte {
+	if n < 128 {
+		return append(buf, byte(n))
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(n)|1<<31)
+}
+
+func (c *fcgiConn) readRecord() (recType uint8, content []byte, err error) {
+	var header [8]byte
+	if _, err = io.ReadFull(c.conn, header[:]); err != nil {
+		return
+	}
+	recType = header[1]
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	content = make([]byte, length+int(header[6]))
+	if _, err = io.ReadFull(c.conn, content); err != nil {
+		return
+	}
+	content = content[:length]
+	return
+}
+
+func serveFastCGI(network, address string, domain DomainConfig, w http.ResponseWriter, r *http.Request, onError func(http.ResponseWriter, *http.Request, error)) {
+	// 和 http.ServeFile 一样拒绝带 .. 的路径，避免执行 Root 以外的脚本
+	if containsDotDot(r.URL.Path) {
+		http.Error(w, "invalid URL path", http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		// chunked 请求没有长度，php 没有 CONTENT_LENGTH 时不会读取请求体，先写入临时文件
+		body, size, err := spoolBody(r.Body)
+		if err != nil {
+			onError(w, r, fmt.Errorf("fastcgi: read body: %w", err))
+			return
+		}
+		defer func() {
+			body.Close()
+			os.Remove(body.Name())
+		}()
+		r.Body, r.ContentLength = body, size
+	}
+	conn, err := net.DialTimeout(network, address, fcgiDialTimeout)
+	if err != nil {
+		onError(w, r, fmt.Errorf("fastcgi: %w", err))
+		return
+	}
+	defer conn.Close()
+	go func() {
+		// 客户端断开时关闭连接，结束读取
+		<-r.Context().Done()
+		conn.Close()
+	}()
+
+	params := fastCGIParams(domain, r)
+	log.Printf("%s %s %s --> %s %s\n", domain.Domain, remoteIP(r), r.URL.Path, address, params["SCRIPT_FILENAME"])
+
+	c := &fcgiConn{conn: conn}
+	begin := []byte{0, fcgiResponder, 0, 0, 0, 0, 0, 0}
+	if err = c.writeRecord(fcgiBeginRequest, begin); err == nil {
+		err = c.writeParams(params)
+	}
+	if err != nil {
+		onError(w, r, fmt.Errorf("fastcgi: %w", err))
+		return
+	}
+
+	// 请求体在单独的 goroutine 中发送，响应可以边收边返回；
+	// php 可能没读完请求体就返回，handler 返回后不能再读取 r.Body，先关闭连接再等待发送结束
+	stdinDone := make(chan struct{})
+	defer func() {
+		conn.Close()
+		<-stdinDone
+	}()
+	go func() {
+		defer close(stdinDone)
+		buf := make([]byte, fcgiMaxWrite)
+		for {
+			n, err := r.Body.Read(buf)
+			if n > 0 {
+				if c.writeRecord(fcgiStdin, buf[:n]) != nil {
+					return
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		c.writeRecord(fcgiStdin, nil)
+	}()
+
+	stdout, stdoutWriter := io.Pipe()
+	go func() {
+		for {
+			recType, content, err := c.readRecord()
+			if err != nil {
+				stdoutWriter.CloseWithError(err)
+				return
+			}
+			switch recType {
+			case fcgiStdout:
+				if len(content) > 0 {
+					if _, err = stdoutWriter.Write(content); err != nil {
+						return
+					}
+				}
+			case fcgiStderr:
+				if len(content) > 0 {
+					log.Printf("fastcgi: %s", strings.TrimSpace(string(content)))
+				}
+			case fcgiEndRequest:
+				stdoutWriter.Close()
+				return
+			}
+		}
+	}()
+	defer stdout.Close()
+
+	reader := bufio.NewReader(stdout)
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil && !(errors.Is(err, io.EOF) && len(header) > 0) {
+		onError(w, r, fmt.Errorf("fastcgi: invalid response: %w", err))
+		return
+	}
+
+	code := http.StatusOK
+	if status := header.Get("status"); status != "" {
+		code, err = strconv.Atoi(strings.SplitN(status, " ", 2)[0])
+		if err != nil {
+			code = http.StatusBadGateway
+		}
+		header.Del("status")
+	} else if header.Get("location") != "" {
+		code = http.StatusFound
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(code)
+	io.Copy(w, reader)
+}
+
+func containsDotDot(v string) bool {
+	if !strings.Contains(v, "..") {
+		return false
+	}
+	for _, segment := range strings.FieldsFunc(v, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func spoolBody(body io.Reader) (*os.File, int64, error) {
+	file, err := os.CreateTemp("", "mini-http-fastcgi-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	size, err := io.Copy(file, body)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, err
+	}
+	return file, size, nil
+}
+
+// 按 CGI/1.1 规范生成参数，SCRIPT_FILENAME 指向域名 Root 下的脚本
+func fastCGIParams(domain DomainConfig, r *http.Request) map[string]string {
+	root, _ := filepath.Abs(domain.Root)
+	scriptName, pathInfo := r.URL.Path, ""
+	if i := strings.Index(scriptName, ".php/"); i >= 0 {
+		scriptName, pathInfo = scriptName[:i+4], scriptName[i+4:]
+	} else if strings.HasSuffix(scriptName, "/") {
+		scriptName = path.Join(scriptName, fcgiDefaultIndex)
+	}
+
+	host, serverPort, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	_, remotePort, _ := net.SplitHostPort(r.RemoteAddr)
+	remoteAddr := remoteIP(r)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "mini-http",
+		"SERVER_PROTOCOL":   r.Proto,
+		"SERVER_NAME":       host,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.URL.RequestURI(),
+		"REQUEST_SCHEME":    scheme,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     root,
+		"DOCUMENT_URI":      scriptName,
+		"SCRIPT_NAME":       scriptName,
+		"SCRIPT_FILENAME":   filepath.Join(root, filepath.FromSlash(scriptName)),
+		"PATH_INFO":         pathInfo,
+		"REMOTE_ADDR":       remoteAddr,
+		"REMOTE_PORT":       remotePort,
+		"CONTENT_TYPE":      r.Header.Get("content-type"),
+		// php-cgi 需要这个参数才会执行脚本
+		"REDIRECT_STATUS": "200",
+	}
+	if pathInfo != "" {
+		params["PATH_TRANSLATED"] = filepath.Join(root, filepath.FromSlash(pathInfo))
+	}
+	if r.ContentLength >= 0 {
+		params["CONTENT_LENGTH"] = strconv.FormatInt(r.ContentLength, 10)
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		serverAddr, port, _ := net.SplitHostPort(addr.String())
+		params["SERVER_ADDR"] = serverAddr
+		if serverPort == "" {
+			serverPort = port
+		}
+	}
+	params["SERVER_PORT"] = serverPort
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	for k, v := range r.Header {
+		k = strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		if k == "PROXY" || k == "CONTENT_TYPE" || k == "CONTENT_LENGTH" {
+			// 避免 httpoxy 漏洞，content-type 和 content-length 已经单独传递
+			continue
+		}
+		params["HTTP_"+k] = strings.Join(v, ", ")
+	}
+	params["HTTP_HOST"] = r.Host
+	return params
+}
@@ -1,35 +1,68 @@
 package static
 
 import (
-	"crypto/tls"
 	"fmt"
 	"io"
 	"log"
 	"mime"
-	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type StaticServerHandler struct {
 	serverConfig ServerConfig
+	acme         *autocert.Manager
 }
 
 func (s *StaticServerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var target string
-	var code int
+	r = s.serverConfig.withClientIP(r)
 	domain := s.serverConfig.CurrentDomain(r.Host)
+	// 开启客户端证书认证的域名不能通过其他域名的 TLS 连接访问
+	if r.TLS != nil && domain.hasClientAuth() && s.serverConfig.CurrentDomain(r.TLS.ServerName).Domain != domain.Domain {
+		http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+		return
+	}
+	if r.TLS == nil && domain.ACME && s.acme != nil {
+		handleACMEHTTP(s.acme, s.serverConfig.httpsRedirectPort(), w, r)
+		return
+	}
+	// 明文请求不能绕过客户端证书认证，能跳转时重定向到 https
+	if r.TLS == nil && domain.hasClientAuth() {
+		if port := s.serverConfig.httpsRedirectPort(); port > 0 {
+			redirectToHTTPS(w, r, port, http.StatusPermanentRedirect)
+		} else {
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		}
+		return
+	}
+	if r.TLS == nil && domain.ForceHTTPS != 0 && s.serverConfig.httpsRedirectPort() > 0 && !strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+		redirectToHTTPS(w, r, s.serverConfig.httpsRedirectPort(), domain.ForceHTTPS)
+		return
+	}
+	if r.TLS != nil && domain.HSTSMaxAge > 0 {
+		w.Header().Set("Strict-Transport-Security", domain.hstsHeader())
+	}
+	// mock 优先，没有匹配的文件时继续代理
+	if handleMock(domain, w, r) {
+		return
+	}
 	// 检查代理配置
 	isProxy := handleProxy(domain, &w, r)
 	if isProxy {
 		return
 	}
-	log.Printf("%s %s\n", domain.label(), r.URL.Path)
+	serveStatic(domain, w, r)
+}
+
+func serveStatic(domain DomainConfig, w http.ResponseWriter, r *http.Request) {
+	var target string
+	var code int
+	log.Printf("%s %s %s\n", domain.label(), remoteIP(r), r.URL.Path)
 	target, code = getSatisfiedFile(&findFileConfig{
 		Root: domain.Root,
 		Path: r.URL.Path,
@@ -146,115 +179,3 @@ func sendFile(w *http.ResponseWriter, file string, code int) {
 	// 使用copy可以避免减少内存占用
 	io.Copy((*w), f)
 }
-
-func handleProxy(domain DomainConfig, w *http.ResponseWriter, r *http.Request) (isProxy bool) {
-	proxies := domain.Proxy
-	isProxy = false
-	if proxies == nil {
-		return
-	}
-	path := r.URL.Path
-	var proxyConfig *DomainProxy
-	for i := 0; i < len(*proxies); i++ {
-		if strings.Index(path, (*proxies)[i].Url) == 0 {
-			proxyConfig = &(*proxies)[i]
-		}
-	}
-	if proxyConfig != nil {
-		isProxy = true
-		if proxyConfig.Instance == nil {
-			proxyConfig.Instance = &httputil.ReverseProxy{
-				Director: func(r *http.Request) {
-					path := r.URL.Path
-					pathIndex := strings.Index(path, proxyConfig.Url)
-					fullUrl := proxyConfig.Proxy + path[pathIndex+len(proxyConfig.Url):]
-					parsedUrl, err := url.Parse(fullUrl)
-					log.Printf("%s %s --> %s\n", domain.Domain, path, fullUrl)
-					if err == nil {
-						r.URL.Scheme = parsedUrl.Scheme
-						r.URL.Host = parsedUrl.Host
-						r.Host = parsedUrl.Host
-						r.URL.Path = parsedUrl.Path
-					}
-				},
-			}
-			proxyConfig.Instance.Transport = &http.Transport{
-				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-			}
-		}
-		if strings.ToLower(r.Header.Get("connection")) == "upgrade" || strings.ToLower(r.Header.Get("upgrade")) == "websocket" {
-			// 需要代理 websocket
-			pathIndex := strings.Index(path, proxyConfig.Url)
-			fullUrl := proxyConfig.Proxy + path[pathIndex+len(proxyConfig.Url):]
-			fullUrl = strings.Replace(fullUrl, "http", "ws", 1)
-			log.Printf("%s %s --> %s\n", domain.Domain, path, fullUrl)
-			handleWebSocketProxy(fullUrl, *w, r)
-		} else {
-			proxyConfig.Instance.ServeHTTP(*w, r)
-		}
-	}
-	return
-}
-
-func handleWebSocketProxy(destURLStr string, w http.ResponseWriter, r *http.Request) {
-	destURL, err := url.Parse(destURLStr)
-	if err != nil {
-		http.Error(w, "Invalid destination URL", http.StatusInternalServerError)
-		return
-	}
-
-	// WebSocket握手
-	h, ok := w.(http.Hijacker)
-	if !ok {
-		http.Error(w, "WebSocket upgrade failed", http.StatusInternalServerError)
-		return
-	}
-	clientConn, _, err := h.Hijack()
-	if err != nil {
-		http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
-		return
-	}
-	defer clientConn.Close()
-
-	destReq := r.Clone(r.Context())
-	destReq.Host = destURL.Host
-	destReq.URL.Path = destURL.Path
-	destReq.URL.RawPath = destURL.RawPath
-	destReq.RequestURI = destURL.RawPath
-
-	destPort := destURL.Port()
-
-	var destConn net.Conn
-	if destURL.Scheme == "wss" {
-		if destPort == "" {
-			destPort = "443"
-		}
-		// 建立TLS连接
-		destConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%s", destURL.Host, destPort), &tls.Config{
-			InsecureSkipVerify: true, // 根据需要设置此项，跳过证书验证
-		})
-	} else {
-		if destPort == "" {
-			destPort = "80"
-		}
-		// 建立TCP连接
-		destConn, err = net.Dial("tcp", destURL.Host)
-	}
-
-	if err != nil {
-		http.Error(w, "Failed to connect to destination server", http.StatusInternalServerError)
-		return
-	}
-	defer destConn.Close()
-
-	// 将客户端的请求写入目标服务器连接
-	err = destReq.Write(destConn)
-	if err != nil {
-		http.Error(w, "Failed to write request to destination server", http.StatusInternalServerError)
-		return
-	}
-
-	// 开始转发消息
-	go io.Copy(destConn, clientConn)
-	io.Copy(clientConn, destConn)
-}
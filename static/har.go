@@ -0,0 +1,497 @@
+package static
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var defaultRedactHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization"}
+
+// 每个请求体和响应体最多记录的字节数，超出部分照常转发但不写入 HAR 文件
+const harMaxBody = 1 << 20
+
+// HAR 1.2 格式，参考 http://www.softwareishard.com/blog/har-12-spec/
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time   `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int            `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int    `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// 记录经过代理的请求和响应，响应体读完或关闭时追加一条记录，
+// 文件一直打开，每次只改写末尾的 ]}，不重写整个文件
+type harRecorder struct {
+	transport http.RoundTripper
+	file      string
+	redact    []string
+
+	mu      sync.Mutex
+	out     *os.File
+	offset  int64
+	entries int
+	trailer []byte
+}
+
+// 启动时打开记录文件，已有的 HAR 文件会保留之前的记录继续追加，
+// 不是有效的 HAR 文件时启动失败，避免覆盖其他内容
+func newHARRecorder(file string, redact []string) (*harRecorder, error) {
+	if len(redact) == 0 {
+		redact = defaultRedactHeaders
+	}
+	h := &harRecorder{file: file, redact: redact}
+	var existing []json.RawMessage
+	if b, err := os.ReadFile(file); err == nil && len(bytes.TrimSpace(b)) > 0 {
+		var har struct {
+			Log struct {
+				Entries []json.RawMessage `json:"entries"`
+			} `json:"log"`
+		}
+		if err = json.Unmarshal(b, &har); err != nil {
+			return nil, fmt.Errorf("%s is not a valid har file, remove it or record to another file: %w", file, err)
+		}
+		existing = har.Log.Entries
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := h.create(existing); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *harRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody *harBody
+	if req.Body != nil && req.Body != http.NoBody {
+		// 请求体边发送边保存，不等上传完成
+		reqBody = &harBody{ReadCloser: req.Body}
+		req.Body = reqBody
+	}
+	start := time.Now()
+	res, err := h.transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	wait := time.Since(start)
+
+	entry := harEntry{
+		StartedDateTime: start,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         req.URL.String(),
+			HTTPVersion: req.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     h.headers(req.Header),
+			QueryString: harQuery(req.URL.Query()),
+			HeadersSize: -1,
+		},
+		Response: harResponse{
+			Status:      res.StatusCode,
+			StatusText:  http.StatusText(res.StatusCode),
+			HTTPVersion: res.Proto,
+			Cookies:     []harNameValue{},
+			Headers:     h.headers(res.Header),
+			RedirectURL: res.Header.Get("location"),
+			HeadersSize: -1,
+		},
+		Timings: harTimings{Send: 0, Wait: milliseconds(wait)},
+	}
+	entry.Response.Content.MimeType = res.Header.Get("content-type")
+
+	finish := func(resBody *harBody) {
+		receive := time.Since(start) - wait
+		entry.Time = milliseconds(wait + receive)
+		entry.Timings.Receive = milliseconds(receive)
+		if reqBody != nil {
+			body, size, truncated := reqBody.content()
+			text, encoding := harText(body)
+			entry.Request.BodySize = size
+			entry.Request.PostData = &harPostData{MimeType: req.Header.Get("content-type"), Text: text, Encoding: encoding, Comment: truncated}
+		}
+		if resBody != nil {
+			body, size, truncated := resBody.content()
+			entry.Response.BodySize = size
+			entry.Response.Content.Size = size
+			entry.Response.Content.Text, entry.Response.Content.Encoding = harText(body)
+			entry.Response.Content.Comment = truncated
+		}
+		if err := h.append(entry); err != nil {
+			log.Printf("har: %v", err)
+		}
+	}
+	// websocket 和 SSE 的响应不会结束，只记录响应头，响应体原样转发
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("content-type"))
+	if res.StatusCode == http.StatusSwitchingProtocols || mediaType == "text/event-stream" {
+		finish(nil)
+		return res, nil
+	}
+	resBody := &harBody{ReadCloser: res.Body}
+	resBody.finish = func() { finish(resBody) }
+	res.Body = resBody
+	return res, nil
+}
+
+// 边转发边保存请求体或响应体，最多保存 harMaxBody 字节；
+// 响应体读到结尾或者关闭时写入记录
+type harBody struct {
+	io.ReadCloser
+	finish func()
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	size int
+	once sync.Once
+}
+
+func (b *harBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if keep := min(n, harMaxBody-b.buf.Len()); keep > 0 {
+		b.buf.Write(p[:keep])
+	}
+	b.size += n
+	b.mu.Unlock()
+	if err == io.EOF {
+		b.done()
+	}
+	return n, err
+}
+
+func (b *harBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done()
+	return err
+}
+
+func (b *harBody) done() {
+	if b.finish != nil {
+		b.once.Do(b.finish)
+	}
+}
+
+// 返回保存的内容和实际大小，超过上限时 truncated 为说明文字
+func (b *harBody) content() (body []byte, size int, truncated string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.size > b.buf.Len() {
+		truncated = fmt.Sprintf("truncated to %d of %d bytes", b.buf.Len(), b.size)
+	}
+	return bytes.Clone(b.buf.Bytes()), b.size, truncated
+}
+
+func (h *harRecorder) append(entry harEntry) error {
+	b, err := json.MarshalIndent(entry, "      ", "  ")
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.write(b)
+}
+
+// 把一条记录插入到 entries 的 ] 前面
+func (h *harRecorder) write(b []byte) error {
+	chunk := []byte(",\n      ")
+	if h.entries == 0 {
+		chunk = []byte("\n      ")
+	}
+	chunk = append(chunk, b...)
+	if _, err := h.out.WriteAt(append(chunk, h.trailer...), h.offset); err != nil {
+		return err
+	}
+	h.offset += int64(len(chunk))
+	h.entries++
+	return nil
+}
+
+// 生成新的 HAR 文件并写入之前的记录，先写临时文件再替换，写入失败时不会丢失原来的记录
+func (h *harRecorder) create(existing []json.RawMessage) error {
+	b, err := json.MarshalIndent(harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "mini-http", Version: "1.0"},
+		Entries: []harEntry{},
+	}}, "", "  ")
+	if err != nil {
+		return err
+	}
+	head, tail, _ := bytes.Cut(b, []byte("[]"))
+	out, err := os.CreateTemp(filepath.Dir(h.file), ".har-*")
+	if err != nil {
+		return err
+	}
+	out.Chmod(0644)
+	trailer := append([]byte("\n    ]"), tail...)
+	trailer = append(trailer, '\n')
+	h.out, h.offset, h.trailer = out, int64(len(head))+1, trailer
+	if _, err = out.WriteAt(append(append([]byte{}, head...), append([]byte("["), trailer...)...), 0); err == nil {
+		for _, raw := range existing {
+			var entry bytes.Buffer
+			if err = json.Indent(&entry, raw, "      ", "  "); err != nil {
+				break
+			}
+			if err = h.write(entry.Bytes()); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), h.file)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		h.out = nil
+	}
+	return err
+}
+
+func (h *harRecorder) headers(header http.Header) []harNameValue {
+	list := []harNameValue{}
+	for k, values := range header {
+		redact := false
+		for _, name := range h.redact {
+			redact = redact || strings.EqualFold(k, name)
+		}
+		for _, v := range values {
+			if redact {
+				v = "REDACTED"
+			}
+			list = append(list, harNameValue{Name: k, Value: v})
+		}
+	}
+	return list
+}
+
+// 从 HAR 文件回放响应，不访问后端。按 method、path、query 以及可选的请求体哈希匹配，
+// 同一个请求有多条记录时按顺序依次返回
+type harReplayer struct {
+	matchBody bool
+
+	mu      sync.Mutex
+	entries []harEntry
+	served  map[int]bool
+}
+
+func newHARReplayer(file string, matchBody bool) (*harReplayer, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var har harFile
+	if err = json.Unmarshal(b, &har); err != nil {
+		return nil, fmt.Errorf("invalid har %s: %w", file, err)
+	}
+	return &harReplayer{matchBody: matchBody, entries: har.Log.Entries, served: map[int]bool{}}, nil
+}
+
+// 读取所有 --proxy-replay 指定的 HAR 文件，打开 --proxy-record 的记录文件
+func (c *ServerConfig) loadHARFiles() (err error) {
+	for _, domain := range append([]DomainConfig{c.DefaultDomain}, c.Domains...) {
+		if domain.Proxy == nil {
+			continue
+		}
+		for i := range *domain.Proxy {
+			p := &(*domain.Proxy)[i]
+			if p.Replay != "" {
+				if p.replayer, err = newHARReplayer(p.Replay, p.ReplayMatchBody); err != nil {
+					return fmt.Errorf("proxy %s replay: %w", p.Url, err)
+				}
+			} else if p.Record != "" {
+				if p.recorder, err = newHARRecorder(p.Record, p.RecordRedact); err != nil {
+					return fmt.Errorf("proxy %s record: %w", p.Url, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (h *harReplayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	var bodyHash [32]byte
+	if h.matchBody {
+		var body []byte
+		if req.Body != nil {
+			body, _ = io.ReadAll(req.Body)
+			req.Body.Close()
+		}
+		bodyHash = sha256.Sum256(body)
+	}
+	query := req.URL.Query().Encode()
+
+	h.mu.Lock()
+	match, fallback := -1, -1
+	for i, entry := range h.entries {
+		u, err := url.Parse(entry.Request.URL)
+		if err != nil || entry.Request.Method != req.Method || u.Path != req.URL.Path || u.Query().Encode() != query {
+			continue
+		}
+		if h.matchBody && sha256.Sum256(harPostBody(entry.Request.PostData)) != bodyHash {
+			continue
+		}
+		fallback = i
+		if !h.served[i] {
+			match = i
+			break
+		}
+	}
+	if match < 0 {
+		match = fallback
+	}
+	if match >= 0 {
+		h.served[match] = true
+	}
+	h.mu.Unlock()
+
+	if match < 0 {
+		body := fmt.Sprintf("no recorded response for %s %s", req.Method, req.URL.RequestURI())
+		return &http.Response{
+			Status:        "404 Not Found",
+			StatusCode:    http.StatusNotFound,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}, "X-Replay": {"MISS"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	recorded := h.entries[match].Response
+	body := harContentBody(recorded.Content)
+	header := http.Header{}
+	for _, nv := range recorded.Headers {
+		header.Add(nv.Name, nv.Value)
+	}
+	header.Set("content-length", strconv.Itoa(len(body)))
+	header.Set("x-replay", "HIT")
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.Status, recorded.StatusText),
+		StatusCode:    recorded.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+func harQuery(values url.Values) []harNameValue {
+	list := []harNameValue{}
+	for k, vs := range values {
+		for _, v := range vs {
+			list = append(list, harNameValue{Name: k, Value: v})
+		}
+	}
+	return list
+}
+
+// 文本内容直接保存，二进制内容使用 base64
+func harText(b []byte) (text string, encoding string) {
+	if utf8.Valid(b) {
+		return string(b), ""
+	}
+	return base64.StdEncoding.EncodeToString(b), "base64"
+}
+
+func harContentBody(content harContent) []byte {
+	if content.Encoding == "base64" {
+		b, _ := base64.StdEncoding.DecodeString(content.Text)
+		return b
+	}
+	return []byte(content.Text)
+}
+
+func harPostBody(postData *harPostData) []byte {
+	if postData == nil {
+		return nil
+	}
+	return harContentBody(harContent{Text: postData.Text, Encoding: postData.Encoding})
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
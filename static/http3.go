@@ -0,0 +1,47 @@
+package static
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// 在 https 端口的 UDP 上提供 HTTP/3，证书和请求处理与 TCP 共用
+func listenHTTP3(c *ServerConfig, tlsConfig *tls.Config, handler http.Handler) (*http3.Server, error) {
+	var conn net.PacketConn
+	if conn = takeInheritedPacketConn(fmt.Sprintf(":%d", c.HTTPSPort)); conn == nil {
+		udpConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: c.HTTPSPort})
+		if err != nil {
+			return nil, err
+		}
+		conn = udpConn
+	}
+	if conn, ok := conn.(*net.UDPConn); ok && c.HTTP3UDPBuffer > 0 {
+		// quic-go 会把小于 7m 的缓冲区继续调大，超出系统限制时以系统为准
+		if err := conn.SetReadBuffer(int(c.HTTP3UDPBuffer)); err != nil {
+			log.Printf("http3: set udp read buffer: %v", err)
+		}
+		if err := conn.SetWriteBuffer(int(c.HTTP3UDPBuffer)); err != nil {
+			log.Printf("http3: set udp write buffer: %v", err)
+		}
+	}
+	server := &http3.Server{
+		Addr:           fmt.Sprintf(":%d", c.HTTPSPort),
+		Port:           c.HTTPSPort,
+		TLSConfig:      tlsConfig,
+		Handler:        handler,
+		IdleTimeout:    c.IdleTimeout,
+		MaxHeaderBytes: int(c.MaxHeaderBytes),
+	}
+	trackHTTP3(server, conn)
+	go func() {
+		if err := server.Serve(conn); err != nil && err != http.ErrServerClosed {
+			log.Printf("http3: %v", err)
+		}
+	}()
+	return server, nil
+}
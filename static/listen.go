@@ -0,0 +1,139 @@
+package static
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const unixPrefix = "unix:"
+
+// --listen 指定的监听地址，protocol 为 http、https 或 auto，
+// auto 和 https 端口一样，TLS 握手走 https，明文请求重定向到 https
+type ListenConfig struct {
+	Address       string
+	Protocol      string
+	Domains       []string
+	ProxyProtocol []string
+
+	trustedProxies []*net.IPNet
+}
+
+// 兼容 --port 和 --https-port，再加上 --listen 指定的地址
+func (c *ServerConfig) listenConfigs() (listens []ListenConfig) {
+	if c.HTTPPort > 0 {
+		listens = append(listens, ListenConfig{Address: fmt.Sprintf(":%d", c.HTTPPort), Protocol: "http", ProxyProtocol: c.ProxyProtocol})
+	}
+	if c.HTTPSPort > 0 {
+		listens = append(listens, ListenConfig{Address: fmt.Sprintf(":%d", c.HTTPSPort), Protocol: "auto", ProxyProtocol: c.ProxyProtocol})
+	}
+	return append(listens, c.Listens...)
+}
+
+func (c *ServerConfig) lastListen() *ListenConfig {
+	if len(c.Listens) == 0 {
+		return nil
+	}
+	return &c.Listens[len(c.Listens)-1]
+}
+
+// http 重定向到 https 时使用的端口，没有 --https-port 时使用第一个 https 监听地址的端口
+func (c *ServerConfig) httpsRedirectPort() int {
+	if c.HTTPSPort > 0 {
+		return c.HTTPSPort
+	}
+	for _, listen := range c.Listens {
+		if listen.Protocol == "http" || strings.HasPrefix(listen.Address, unixPrefix) {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(listen.Address); err == nil {
+			if n, err := strconv.Atoi(port); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+func (l *ListenConfig) useTLS() bool {
+	return l.Protocol == "https" || l.Protocol == "auto"
+}
+
+func (l *ListenConfig) listen() (net.Listener, error) {
+	switch l.Protocol {
+	case "http", "https", "auto":
+	default:
+		return nil, fmt.Errorf("listen %s: unknown protocol %s, use http, https or auto", l.Address, l.Protocol)
+	}
+	trusted, err := parseCIDRs(l.ProxyProtocol)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: proxy protocol: %w", l.Address, err)
+	}
+	l.trustedProxies = trusted
+	if ln := takeInheritedListener(l.Address); ln != nil {
+		return ln, nil
+	}
+	if file, ok := strings.CutPrefix(l.Address, unixPrefix); ok {
+		// 上次退出时没有清理的 socket 文件会导致监听失败
+		if info, err := os.Lstat(file); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(file)
+		}
+		return net.Listen("unix", file)
+	}
+	return net.Listen("tcp", l.Address)
+}
+
+// 限制了域名的监听地址只处理这些域名的请求
+func (l *ListenConfig) restrict(c *ServerConfig, handler http.Handler) http.Handler {
+	if len(l.Domains) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !l.allow(c, r.Host) {
+			http.Error(w, http.StatusText(http.StatusMisdirectedRequest), http.StatusMisdirectedRequest)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (l *ListenConfig) allow(c *ServerConfig, host string) bool {
+	host = hostname(host)
+	domain, matched := c.matchDomain(host)
+	for _, name := range l.Domains {
+		if name == host || matchWildcard(name, host) || (matched && name == domain.Domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// 开启 PROXY protocol 时从可信的负载均衡获取客户端地址
+func (l *ListenConfig) acceptProxyProtocol(ln net.Listener) net.Listener {
+	if len(l.trustedProxies) == 0 {
+		return ln
+	}
+	return &proxyProtocolListener{Listener: ln, trusted: l.trustedProxies}
+}
+
+func (l *ListenConfig) print() {
+	fmt.Printf("Listen: \t%s %s", l.Protocol, l.Address)
+	if len(l.Domains) > 0 {
+		fmt.Printf(" (%s)", strings.Join(l.Domains, ", "))
+	}
+	if len(l.ProxyProtocol) > 0 {
+		fmt.Printf(" proxy protocol from %s", strings.Join(l.ProxyProtocol, ", "))
+	}
+	fmt.Println("")
+}
+
+// 去掉端口，IPv6 地址去掉方括号
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.Trim(host, "[]")
+}
@@ -0,0 +1,117 @@
+package static
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMirrorTimeout = 5 * time.Second
+	defaultMirrorBody    = 1 << 20
+	maxMirrorRequests    = 64
+)
+
+// 所有镜像请求共用，超过并发上限的镜像请求直接丢弃
+var mirrorSlots = make(chan struct{}, maxMirrorRequests)
+
+var mirrorClient = &http.Client{
+	Transport: &http.Transport{
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+		MaxIdleConnsPerHost: maxMirrorRequests,
+	},
+	CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// 按采样比例把请求复制一份异步发送到 Mirror，忽略其响应，不影响主请求
+func (p *DomainProxy) mirror(r *http.Request) {
+	if p.Mirror == "" || rand.Float64()*100 >= p.MirrorPercent {
+		return
+	}
+	target, err := url.Parse(p.Mirror)
+	if err != nil {
+		return
+	}
+	limit := p.MirrorMaxBody
+	if limit <= 0 {
+		limit = defaultMirrorBody
+	}
+	if r.ContentLength > limit {
+		return
+	}
+
+	joinProxyURL(target, strings.TrimPrefix(r.URL.Path, p.Url), r.URL.RawQuery)
+	method, header := r.Method, r.Header.Clone()
+	timeout := p.MirrorTimeout
+	if timeout <= 0 {
+		timeout = defaultMirrorTimeout
+	}
+	send := func(body []byte) {
+		select {
+		case mirrorSlots <- struct{}{}:
+		default:
+			return
+		}
+		go func() {
+			defer func() { <-mirrorSlots }()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			req, err := http.NewRequestWithContext(ctx, method, target.String(), bytes.NewReader(body))
+			if err != nil {
+				return
+			}
+			req.Header = header
+			req.Header.Del("connection")
+			req.Header.Set("x-mirror", "1")
+			res, err := mirrorClient.Do(req)
+			if err != nil {
+				log.Printf("mirror %s: %v", target, err)
+				return
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}()
+	}
+
+	if r.Body == nil || r.Body == http.NoBody {
+		send(nil)
+		return
+	}
+	r.Body = &mirrorBody{ReadCloser: r.Body, limit: limit, send: send}
+}
+
+// 主请求读取请求体时复制一份，读完后再发送镜像请求；
+// 超过 limit 或者没有读完就关闭时放弃镜像
+type mirrorBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	done  bool
+	send  func([]byte)
+}
+
+func (b *mirrorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.done {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.done = true
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && !b.done {
+		b.done = true
+		b.send(b.buf.Bytes())
+	}
+	return n, err
+}
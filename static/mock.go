@@ -0,0 +1,142 @@
+package static
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const mockMetaSuffix = ".meta.json"
+
+type DomainMock struct {
+	Url   string
+	Dir   string
+	Delay time.Duration
+}
+
+// 与 mock 文件同名的 .meta.json 用来声明状态码、响应头和延迟
+type mockMeta struct {
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	Delay   string            `json:"delay"`
+}
+
+// 按 方法/路径 查找 mock 文件，例如 GET /api/users/1 对应 mocks/GET/users/{id}.json，
+// 找不到时返回 false，交给代理或静态资源继续处理
+func handleMock(domain DomainConfig, w http.ResponseWriter, r *http.Request) bool {
+	if domain.Mock == nil {
+		return false
+	}
+	for _, mock := range *domain.Mock {
+		if !strings.HasPrefix(r.URL.Path, mock.Url) {
+			continue
+		}
+		segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, mock.Url), "/"), "/")
+		for _, method := range []string{r.Method, "ANY"} {
+			// 方法名作为目录名使用，不能跳出 mock 目录
+			if strings.ContainsAny(method, `./\`) {
+				continue
+			}
+			params := map[string]string{}
+			file := findMockFile(filepath.Join(mock.Dir, method), segments, params)
+			if file != "" {
+				log.Printf("%s %s %s --> mock %s\n", domain.label(), remoteIP(r), r.URL.Path, file)
+				serveMock(mock, file, params, w, r)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 逐级匹配路径，优先使用同名的文件或目录，其次使用 {name} 形式的参数
+func findMockFile(dir string, segments []string, params map[string]string) string {
+	if len(segments) == 1 && segments[0] == "" {
+		segments = []string{"index"}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return ""
+	}
+	segment := segments[0]
+	last := len(segments) == 1
+	var candidates []os.DirEntry
+	for _, entry := range entries {
+		name := entry.Name()
+		if last && !entry.IsDir() && !strings.HasSuffix(name, mockMetaSuffix) {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		} else if last || !entry.IsDir() {
+			continue
+		}
+		if name == segment {
+			candidates = append([]os.DirEntry{entry}, candidates...)
+		} else if strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}") {
+			candidates = append(candidates, entry)
+		}
+	}
+	for _, entry := range candidates {
+		name := entry.Name()
+		if last {
+			name = strings.TrimSuffix(name, filepath.Ext(name))
+		}
+		if strings.HasPrefix(name, "{") {
+			params[strings.Trim(name, "{}")] = segment
+		}
+		if last {
+			return filepath.Join(dir, entry.Name())
+		}
+		if file := findMockFile(filepath.Join(dir, entry.Name()), segments[1:], params); file != "" {
+			return file
+		}
+		delete(params, strings.Trim(name, "{}"))
+	}
+	return ""
+}
+
+func serveMock(mock DomainMock, file string, params map[string]string, w http.ResponseWriter, r *http.Request) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	meta := mockMeta{Status: http.StatusOK}
+	if b, err := os.ReadFile(strings.TrimSuffix(file, filepath.Ext(file)) + mockMetaSuffix); err == nil {
+		if err = json.Unmarshal(b, &meta); err != nil {
+			log.Printf("mock: invalid %s: %v", file, err)
+		}
+	}
+
+	delay := mock.Delay
+	if d, err := time.ParseDuration(meta.Delay); err == nil {
+		delay = d
+	}
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// 用路径参数替换内容中的 {{name}}
+	body := string(content)
+	for k, v := range params {
+		body = strings.ReplaceAll(body, "{{"+k+"}}", v)
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(file)); contentType != "" {
+		w.Header().Set("content-type", contentType)
+	}
+	for k, v := range meta.Headers {
+		w.Header().Set(k, v)
+	}
+	if meta.Status == 0 {
+		meta.Status = http.StatusOK
+	}
+	w.WriteHeader(meta.Status)
+	w.Write([]byte(body))
+}
@@ -0,0 +1,117 @@
+package static
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// 转发给代理后端的客户端证书信息，客户端自己带的同名请求头会被删除
+const (
+	clientVerifyHeader  = "X-Client-Verify"
+	clientSubjectHeader = "X-Client-Subject"
+	clientSANsHeader    = "X-Client-Sans"
+)
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.RequestClientCert,
+	"require": tls.RequireAnyClientCert,
+	"verify":  tls.RequireAndVerifyClientCert,
+}
+
+func (d *DomainConfig) clientAuthType() (tls.ClientAuthType, error) {
+	mode := d.ClientAuth
+	if mode == "" && d.ClientCA != "" {
+		mode = "verify"
+	}
+	if mode == "" {
+		return tls.NoClientCert, nil
+	}
+	authType, ok := clientAuthTypes[mode]
+	if !ok {
+		return tls.NoClientCert, fmt.Errorf("%s: invalid client-auth %s", d.label(), mode)
+	}
+	// 配置了 CA 时，request 和 require 模式下客户端提供的证书也需要通过校验
+	if d.ClientCA != "" {
+		switch authType {
+		case tls.RequestClientCert:
+			authType = tls.VerifyClientCertIfGiven
+		case tls.RequireAnyClientCert:
+			authType = tls.RequireAndVerifyClientCert
+		}
+	}
+	// 没有 client-ca 时 Go 会使用系统根证书校验客户端证书
+	if authType == tls.RequireAndVerifyClientCert && d.ClientCA == "" {
+		return tls.NoClientCert, fmt.Errorf("%s: client-auth %s requires client-ca", d.label(), mode)
+	}
+	return authType, nil
+}
+
+func (d *DomainConfig) hasClientAuth() bool {
+	authType, err := d.clientAuthType()
+	return err == nil && authType != tls.NoClientCert
+}
+
+// 按 client-auth 和 client-ca 设置客户端证书认证，没有开启时返回 false
+func (d *DomainConfig) applyClientAuth(config *tls.Config) (bool, error) {
+	authType, err := d.clientAuthType()
+	if err != nil || authType == tls.NoClientCert {
+		return false, err
+	}
+	config.ClientAuth = authType
+	if d.ClientCA != "" {
+		content, err := os.ReadFile(d.ClientCA)
+		if err != nil {
+			return false, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(content) {
+			return false, fmt.Errorf("%s: no certificate found in client-ca %s", d.label(), d.ClientCA)
+		}
+	}
+	return true, nil
+}
+
+// 只有通过校验的客户端证书才会转发 subject 和 SAN
+func setClientCertHeaders(r *http.Request) {
+	r.Header.Del(clientVerifyHeader)
+	r.Header.Del(clientSubjectHeader)
+	r.Header.Del(clientSANsHeader)
+	if r.TLS == nil {
+		return
+	}
+	if len(r.TLS.PeerCertificates) == 0 {
+		r.Header.Set(clientVerifyHeader, "NONE")
+		return
+	}
+	if len(r.TLS.VerifiedChains) == 0 {
+		r.Header.Set(clientVerifyHeader, "UNVERIFIED")
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	r.Header.Set(clientVerifyHeader, "SUCCESS")
+	r.Header.Set(clientSubjectHeader, cert.Subject.String())
+	if sans := certificateSANs(cert); len(sans) > 0 {
+		r.Header.Set(clientSANsHeader, strings.Join(sans, ", "))
+	}
+}
+
+func certificateSANs(cert *x509.Certificate) (sans []string) {
+	for _, name := range cert.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range cert.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package static
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspTimeout    = 10 * time.Second
+	ocspRetry      = 5 * time.Minute
+	ocspMaxRefresh = 24 * time.Hour
+)
+
+var ocspClient = &http.Client{Timeout: ocspTimeout}
+
+// 为文件证书获取 OCSP 响应并附加到握手中，响应在 thisUpdate 和 nextUpdate 中间刷新，
+// 获取失败时继续使用未过期的旧响应，过期后不再附加
+type ocspStapler struct {
+	changed chan struct{}
+
+	leaf       []byte
+	raw        []byte
+	nextUpdate time.Time
+	refresh    time.Time
+}
+
+func (c *certReloader) stapleOCSP() {
+	for {
+		wait := c.updateOCSP()
+		select {
+		case <-time.After(wait):
+		case <-c.ocsp.changed:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// 返回下一次检查前需要等待的时间
+func (c *certReloader) updateOCSP() time.Duration {
+	cert, _ := c.getCertificate()
+	if cert == nil || cert.Leaf == nil || len(cert.Leaf.OCSPServer) == 0 {
+		return ocspMaxRefresh
+	}
+	s := c.ocsp
+	now := time.Now()
+	if bytes.Equal(s.leaf, cert.Leaf.Raw) && now.Before(s.refresh) {
+		// 重新加载的证书文件内容没变时继续使用已有的响应
+		if cert.OCSPStaple == nil && s.raw != nil && (s.nextUpdate.IsZero() || now.Before(s.nextUpdate)) {
+			c.setStaple(cert, s.raw)
+		}
+		return s.refresh.Sub(now)
+	}
+	if !bytes.Equal(s.leaf, cert.Leaf.Raw) {
+		s.leaf, s.raw, s.nextUpdate = cert.Leaf.Raw, nil, time.Time{}
+	}
+	if len(cert.Certificate) < 2 {
+		log.Printf("%s ocsp: no issuer certificate in %s, skip stapling", c.domain.label(), c.domain.Cert)
+		s.refresh = now.Add(ocspMaxRefresh)
+		return ocspMaxRefresh
+	}
+
+	response, raw, err := fetchOCSP(cert)
+	if err != nil {
+		log.Printf("%s ocsp: %v", c.domain.label(), err)
+		if !s.nextUpdate.IsZero() && now.After(s.nextUpdate) {
+			s.raw = nil
+			if cert.OCSPStaple != nil {
+				c.setStaple(cert, nil)
+			}
+		} else if cert.OCSPStaple == nil && s.raw != nil {
+			c.setStaple(cert, s.raw)
+		}
+		s.refresh = now.Add(ocspRetry)
+		return ocspRetry
+	}
+
+	c.setStaple(cert, raw)
+	s.raw, s.nextUpdate = raw, response.NextUpdate
+	s.refresh = now.Add(ocspMaxRefresh)
+	if !response.NextUpdate.IsZero() {
+		s.refresh = response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+	}
+	if s.refresh.Before(now.Add(time.Minute)) {
+		s.refresh = now.Add(time.Minute)
+	}
+	log.Printf("%s ocsp: stapled response, next update at %s", c.domain.label(), response.NextUpdate.Format(time.RFC3339))
+	return s.refresh.Sub(now)
+}
+
+// 证书在获取期间被替换时放弃这次结果
+func (c *certReloader) setStaple(cert *tls.Certificate, staple []byte) {
+	stapled := *cert
+	stapled.OCSPStaple = staple
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert == cert {
+		c.cert = &stapled
+	}
+}
+
+func fetchOCSP(cert *tls.Certificate) (*ocsp.Response, []byte, error) {
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err := ocsp.CreateRequest(cert.Leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ocspTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cert.Leaf.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("content-type", "application/ocsp-request")
+	res, err := ocspClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder %s returned %s", cert.Leaf.OCSPServer[0], res.Status)
+	}
+	raw, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(raw, cert.Leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case response.Status == ocsp.Revoked:
+		return nil, nil, errors.New("certificate has been revoked")
+	case response.Status != ocsp.Good:
+		return nil, nil, errors.New("certificate status unknown")
+	case !response.NextUpdate.IsZero() && response.NextUpdate.Before(time.Now()):
+		return nil, nil, errors.New("response expired")
+	}
+	return response, raw, nil
+}
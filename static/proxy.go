@@ -0,0 +1,338 @@
+package static
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWSHandshakeTimeout = 10 * time.Second
+	defaultWSIdleTimeout      = 5 * time.Minute
+)
+
+var proxyMutex sync.Mutex
+
+func handleProxy(domain DomainConfig, w *http.ResponseWriter, r *http.Request) (isProxy bool) {
+	proxies := domain.Proxy
+	isProxy = false
+	if proxies == nil {
+		return
+	}
+	path := r.URL.Path
+	if domain.CachePurge != "" && path == domain.CachePurge {
+		purgeCache(domain, *w, r)
+		return true
+	}
+	var proxyConfig *DomainProxy
+	for i := 0; i < len(*proxies); i++ {
+		if strings.Index(path, (*proxies)[i].Url) == 0 {
+			proxyConfig = &(*proxies)[i]
+		}
+	}
+	if proxyConfig != nil {
+		isProxy = true
+		setClientCertHeaders(r)
+		// 后端通过 X-Real-IP 获取客户端地址，X-Forwarded-For 由 ReverseProxy 追加
+		r.Header.Set("X-Real-IP", remoteIP(r))
+		if isUpgradeRequest(r) {
+			// websocket 等协议升级请求交给 ReverseProxy 处理，它会校验 101 响应并双向转发
+			proxyConfig.webSocketInstance(domain).ServeHTTP(*w, r)
+		} else {
+			if proxyConfig.MaxBodySize > 0 {
+				if r.ContentLength > proxyConfig.MaxBodySize {
+					http.Error(*w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = http.MaxBytesReader(*w, r.Body, proxyConfig.MaxBodySize)
+			}
+			sw := &streamResponseWriter{
+				ResponseWriter: *w,
+				flushAlways:    proxyConfig.DisableBuffering,
+			}
+			r = r.WithContext(context.WithValue(r.Context(), originalRequestContextKey{}, r))
+			proxyConfig.mirror(r)
+			if network, address, ok := proxyConfig.fastCGIAddress(); ok {
+				serveFastCGI(network, address, domain, sw, r, proxyConfig.errorHandler(domain))
+			} else {
+				proxyConfig.instance(domain).ServeHTTP(sw, r)
+			}
+		}
+	}
+	return
+}
+
+type originalRequestContextKey struct{}
+
+// Director 会改写请求地址，需要客户端的原始请求时从 context 中取出
+func originalRequest(r *http.Request) *http.Request {
+	if original, ok := r.Context().Value(originalRequestContextKey{}).(*http.Request); ok {
+		return original
+	}
+	return r
+}
+
+func isUpgradeRequest(r *http.Request) bool {
+	for _, v := range r.Header.Values("connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return r.Header.Get("upgrade") != ""
+			}
+		}
+	}
+	return false
+}
+
+func (p *DomainProxy) instance(domain DomainConfig) *httputil.ReverseProxy {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+	if p.Instance == nil {
+		transport := p.newTransport(&net.Dialer{})
+		if _, _, h2c := p.upstream(); h2c {
+			// h2c 直接以 HTTP/2 明文连接后端，gRPC 的 trailer 由 ReverseProxy 原样转发
+			transport.Protocols = new(http.Protocols)
+			transport.Protocols.SetUnencryptedHTTP2(true)
+		}
+		var roundTripper http.RoundTripper = transport
+		if p.replayer != nil {
+			roundTripper = p.replayer
+		} else if p.recorder != nil {
+			p.recorder.transport = transport
+			roundTripper = p.recorder
+		}
+		if p.CacheSize > 0 || p.CacheDir != "" {
+			p.cache = newHTTPCache(roundTripper, p.CacheSize, p.CacheDir)
+			roundTripper = p.cache
+		}
+		p.Instance = &httputil.ReverseProxy{
+			Director:       p.director(domain),
+			Transport:      roundTripper,
+			ModifyResponse: p.modifyResponse,
+			ErrorHandler:   p.errorHandler(domain),
+		}
+		if p.DisableBuffering {
+			p.Instance.FlushInterval = -1
+		}
+	}
+	return p.Instance
+}
+
+func (p *DomainProxy) webSocketInstance(domain DomainConfig) *httputil.ReverseProxy {
+	proxyMutex.Lock()
+	defer proxyMutex.Unlock()
+	if p.WebSocket == nil {
+		handshakeTimeout := p.WSHandshakeTimeout
+		if handshakeTimeout <= 0 {
+			handshakeTimeout = defaultWSHandshakeTimeout
+		}
+		idleTimeout := p.WSIdleTimeout
+		if idleTimeout == 0 {
+			idleTimeout = defaultWSIdleTimeout
+		}
+		transport := p.newTransport(&net.Dialer{Timeout: handshakeTimeout})
+		dial := transport.DialContext
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := dial(ctx, network, addr)
+			if err != nil || idleTimeout < 0 {
+				return conn, err
+			}
+			return &idleTimeoutConn{Conn: conn, timeout: idleTimeout}, nil
+		}
+		transport.TLSHandshakeTimeout = handshakeTimeout
+		transport.ResponseHeaderTimeout = handshakeTimeout
+		transport.DisableKeepAlives = true
+		p.WebSocket = &httputil.ReverseProxy{
+			Director:  p.director(domain),
+			Transport: transport,
+		}
+	}
+	return p.WebSocket
+}
+
+func (p *DomainProxy) newTransport(dialer *net.Dialer) *http.Transport {
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext:     dialer.DialContext,
+	}
+	if _, socket, _ := p.upstream(); socket != "" {
+		// 后端监听在 unix socket 上，忽略请求中的地址
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	return transport
+}
+
+// 解析代理目标，支持 http(s)://、ws(s)://、h2c://、unix:///run/app.sock 以及 h2c+unix:///run/app.sock
+func (p *DomainProxy) upstream() (target *url.URL, socket string, h2c bool) {
+	target, err := url.Parse(p.Proxy)
+	if err != nil {
+		return nil, "", false
+	}
+	scheme := target.Scheme
+	if strings.HasPrefix(scheme, "h2c") {
+		h2c = true
+		scheme = strings.TrimPrefix(strings.TrimPrefix(scheme, "h2c"), "+")
+	}
+	switch scheme {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	case "unix":
+		socket = target.Path
+		target.Scheme = "http"
+		target.Host = "localhost"
+		target.Path = ""
+	case "":
+		target.Scheme = "http"
+	}
+	return
+}
+
+func (p *DomainProxy) director(domain DomainConfig) func(r *http.Request) {
+	return func(r *http.Request) {
+		path := r.URL.Path
+		pathIndex := strings.Index(path, p.Url)
+		parsedUrl, socket, _ := p.upstream()
+		if parsedUrl == nil {
+			log.Printf("%s %s --> invalid proxy %s\n", domain.Domain, path, p.Proxy)
+			return
+		}
+		joinProxyURL(parsedUrl, path[pathIndex+len(p.Url):], r.URL.RawQuery)
+		if socket != "" {
+			log.Printf("%s %s %s --> unix:%s %s\n", domain.Domain, remoteIP(r), path, socket, parsedUrl.RequestURI())
+		} else {
+			log.Printf("%s %s %s --> %s\n", domain.Domain, remoteIP(r), path, parsedUrl.String())
+			r.Host = parsedUrl.Host
+		}
+		r.URL.Scheme = parsedUrl.Scheme
+		r.URL.Host = parsedUrl.Host
+		r.URL.Path = parsedUrl.Path
+		r.URL.RawPath = ""
+		r.URL.RawQuery = parsedUrl.RawQuery
+	}
+}
+
+// 代理地址中可能带有 query，需要先拆开再拼接路径
+func joinProxyURL(target *url.URL, path string, rawQuery string) {
+	target.Path += path
+	target.RawPath = ""
+	if target.RawQuery == "" || rawQuery == "" {
+		target.RawQuery += rawQuery
+	} else {
+		target.RawQuery += "&" + rawQuery
+	}
+}
+
+// 带 trailer 的响应不能以 Content-Length 返回，否则 HTTP/1.1 客户端收不到 trailer
+func keepTrailers(res *http.Response) error {
+	if len(res.Trailer) > 0 {
+		res.Header.Del("content-length")
+		res.ContentLength = -1
+	}
+	return nil
+}
+
+func (p *DomainProxy) modifyResponse(res *http.Response) error {
+	if err := p.checkFallbackStatus(res); err != nil {
+		return err
+	}
+	return keepTrailers(res)
+}
+
+func (p *DomainProxy) errorHandler(domain DomainConfig) func(w http.ResponseWriter, r *http.Request, err error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		r = originalRequest(r)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+		if p.Fallback != "" && r.Context().Err() == nil {
+			log.Printf("%s %s proxy error: %v, fallback to %s\n", domain.label(), r.URL.Path, err, p.Fallback)
+			p.serveFallback(domain, w, r)
+			return
+		}
+		log.Printf("http: proxy error: %v", err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+}
+
+var streamingContentTypes = []string{
+	"text/event-stream",
+	"application/x-ndjson",
+	"application/stream+json",
+	"application/grpc",
+	"multipart/x-mixed-replace",
+}
+
+func isStreamingContentType(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, t := range streamingContentTypes {
+		if mediaType == t || strings.HasPrefix(mediaType, t+"+") {
+			return true
+		}
+	}
+	return false
+}
+
+// 流式响应每次写入后立即 flush，并取消服务端的读写超时，避免长连接的 SSE 被掐断
+type streamResponseWriter struct {
+	http.ResponseWriter
+	flushAlways bool
+	streaming   bool
+}
+
+func (w *streamResponseWriter) WriteHeader(code int) {
+	if isStreamingContentType(w.Header().Get("content-type")) {
+		w.streaming = true
+		rc := http.NewResponseController(w.ResponseWriter)
+		rc.SetReadDeadline(time.Time{})
+		rc.SetWriteDeadline(time.Time{})
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *streamResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	if err == nil && (w.streaming || w.flushAlways) {
+		w.Flush()
+	}
+	return n, err
+}
+
+func (w *streamResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *streamResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// 每次读写都会顺延超时时间，连接空闲超过 timeout 后读写失败并关闭两端
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *idleTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
@@ -0,0 +1,113 @@
+package static
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const defaultRealIPHeader = "X-Forwarded-For"
+
+type clientIPContextKey struct{}
+
+// 请求来自 --trusted-proxies 时从 --real-ip-header 中取出客户端地址，
+// 每个请求只计算一次，保存在 context 中
+func (c *ServerConfig) withClientIP(r *http.Request) *http.Request {
+	ip := peerIP(r)
+	if len(c.trustedProxies) > 0 && c.trusted(ip) {
+		ip = c.realIP(r, ip)
+	}
+	return r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, ip))
+}
+
+func (c *ServerConfig) realIP(r *http.Request, peer string) string {
+	header := http.CanonicalHeaderKey(c.RealIPHeader)
+	var hops []string
+	switch header {
+	case "", defaultRealIPHeader:
+		for _, value := range r.Header.Values(defaultRealIPHeader) {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	default:
+		// X-Real-IP、CF-Connecting-IP 这类只有一个地址的请求头
+		if ip := parseHopIP(r.Header.Get(header)); ip != "" {
+			return ip
+		}
+		return peer
+	}
+	// 从右往左跳过可信的代理，第一个不可信的地址就是客户端
+	ip := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHopIP(hops[i])
+		if hop == "" {
+			break
+		}
+		ip = hop
+		if !c.trusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (c *ServerConfig) trusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range c.trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// 取出 Forwarded: for=192.0.2.60;proto=http, for="[2001:db8::17]:4711" 中的 for
+func forwardedFor(values []string) (hops []string) {
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = strings.Trim(val, `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return
+}
+
+// 支持 1.2.3.4、1.2.3.4:80、[::1]:80 和 ::1，unknown 或隐藏的地址返回空
+func parseHopIP(hop string) string {
+	hop = strings.TrimSpace(hop)
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	ip := net.ParseIP(strings.Trim(hop, "[]"))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// 直接连接的地址，不带端口
+func peerIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// 客户端地址，经过可信代理时是代理转发的真实地址
+func remoteIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return peerIP(r)
+}
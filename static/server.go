@@ -2,6 +2,7 @@ package static
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -9,23 +10,68 @@ import (
 	"net/http"
 	"net/url"
 	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 func RunServer(args []string) (err error) {
 	serverConfig := ServerConfig{
-		HTTPPort:      80,
-		HTTPSPort:     0,
-		Domains:       []DomainConfig{},
-		DefaultDomain: NewDomain(),
+		HTTPPort:           80,
+		HTTPSPort:          0,
+		Domains:            []DomainConfig{},
+		DefaultDomain:      NewDomain(),
+		CertReloadInterval: defaultCertReloadInterval,
+		ShutdownTimeout:    defaultShutdownTimeout,
+		RealIPHeader:       defaultRealIPHeader,
+		ReadHeaderTimeout:  defaultReadHeaderTimeout,
+		IdleTimeout:        defaultIdleTimeout,
+		MaxHeaderBytes:     http.DefaultMaxHeaderBytes,
 	}
 	serverConfig.ParseFromArgs(args)
+	if serverConfig.trustedProxies, err = parseCIDRs(serverConfig.TrustedProxies); err != nil {
+		return fmt.Errorf("trusted proxies: %w", err)
+	}
+	for _, domain := range append([]DomainConfig{serverConfig.DefaultDomain}, serverConfig.Domains...) {
+		if _, err = domain.clientAuthType(); err != nil {
+			return
+		}
+	}
+	// 回放文件读取失败时直接启动失败，不然所有请求都会返回 404
+	if err = serverConfig.loadHARFiles(); err != nil {
+		return
+	}
 
 	fmt.Println("Starting Mini HTTP...")
 
+	// 指定的 CA 有问题时直接启动失败
+	serverCA := newCA(&serverConfig)
+	if serverConfig.CACert != "" || serverConfig.CAKey != "" {
+		if err = serverCA.generateRootCertificate(); err != nil {
+			return
+		}
+	} else if _, err = parseSubject(serverConfig.CASubject); err != nil {
+		return
+	}
+
+	acmeManager, err := newACMEManager(&serverConfig)
+	if err != nil {
+		return
+	}
+	if acmeManager != nil && serverConfig.HTTPSPort == 0 {
+		serverConfig.HTTPSPort = 443
+	}
+
 	handler := &StaticServerHandler{
 		serverConfig: serverConfig,
+		acme:         acmeManager,
 	}
 
+	listens := serverConfig.listenConfigs()
 	fmt.Printf("Listen TCP: ")
 	if serverConfig.HTTPPort > 0 {
 		fmt.Printf("%d ", serverConfig.HTTPPort)
@@ -33,140 +79,295 @@ func RunServer(args []string) (err error) {
 	if serverConfig.HTTPSPort > 0 {
 		fmt.Printf("%d ", serverConfig.HTTPSPort)
 	}
+	if serverConfig.HTTP3 && serverConfig.HTTPSPort > 0 {
+		fmt.Printf("UDP: %d ", serverConfig.HTTPSPort)
+	}
 	fmt.Println("")
 	serverConfig.PrintConfig()
 
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", serverConfig.HTTPPort))
-	if err != nil {
-		log.Panic(err)
-		return
-	}
-
-	go func() {
-		if err := http.Serve(ln, handler); err != nil {
-			log.Panic(err)
+	// 任意一个地址监听失败时关闭已经打开的地址
+	listeners := make([]net.Listener, 0, len(listens))
+	defer func() {
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
 		}
 	}()
+	var useTLS bool
+	for i := range listens {
+		ln, err := listens[i].listen()
+		if err != nil {
+			return err
+		}
+		listeners = append(listeners, ln)
+		useTLS = useTLS || listens[i].useTLS()
+	}
 
-	if serverConfig.HTTPSPort > 0 {
-		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", serverConfig.HTTPSPort))
+	var httpHandler http.Handler = handler
+	if serverConfig.H2C {
+		// 明文 HTTP/2，同时支持 prior knowledge 和 Upgrade: h2c 两种方式，仅用于内网
+		httpHandler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: serverConfig.IdleTimeout})
+	}
+
+	var tlsConfig *tls.Config
+	var h3 *http3.Server
+	var reloaders []*certReloader
+	defer func() {
 		if err != nil {
-			log.Panic(err)
+			for _, reloader := range reloaders {
+				reloader.stop()
+			}
+		}
+	}()
+	if useTLS {
+		if tlsConfig, reloaders, err = newTLSConfig(&serverConfig, serverCA, acmeManager); err != nil {
+			return
+		}
+		if serverConfig.HTTP3 && serverConfig.HTTPSPort > 0 {
+			if h3, err = listenHTTP3(&serverConfig, tlsConfig, handler); err != nil {
+				return
+			}
 		}
-		var certStore sync.Map
-		var certMutex sync.Mutex
-		tlsConfig := &tls.Config{
-			GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
-				domainName := chi.ServerName
-				if domainName == "" {
-					domainName = "localhost"
-				}
-				certMutex.Lock()
-				defer certMutex.Unlock()
-				if cert, ok := certStore.Load(chi.ServerName); ok {
-					return cert.(*tls.Certificate), nil
-				}
-				domain := serverConfig.CurrentDomain(chi.ServerName)
-				if domain.Cert != "" && domain.Key != "" {
-					cert, err := domain.loadCertificate()
-					if err == nil {
-						certStore.Store(chi.ServerName, cert)
-					}
-					return cert, err
-				} else {
-					cert, err := ca.issueCertificate(domainName)
-					if err == nil {
-						certStore.Store(domainName, cert)
-					}
-					return cert, err
-				}
-			},
+	}
+	httpsHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil {
+			u := url.URL{
+				Scheme:   "https",
+				Opaque:   r.URL.Opaque,
+				User:     r.URL.User,
+				Host:     r.Host,
+				Path:     r.URL.Path,
+				RawQuery: r.URL.RawQuery,
+				Fragment: r.URL.Fragment,
+			}
+			// 如果通过http访问，则自动重定向到https
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+		} else {
+			if h3 != nil {
+				// 告诉客户端可以改用 HTTP/3
+				h3.SetQUICHeaders(w.Header())
+			}
+			handler.ServeHTTP(w, r)
 		}
+	})
+
+	// systemd 或旧进程传入但没有对应 --listen 的 socket 按 http 处理
+	for _, ln := range takeRemainingInherited() {
+		log.Printf("serve inherited %s %s as http", ln.Addr().Network(), ln.Addr())
+		listens = append(listens, ListenConfig{Address: ln.Addr().String(), Protocol: "http"})
+		listeners = append(listeners, ln)
+	}
+
+	// 所有监听地址共用连接数上限
+	var sem chan struct{}
+	if serverConfig.MaxConnections > 0 {
+		sem = make(chan struct{}, serverConfig.MaxConnections)
+	}
+	servers := make([]*http.Server, 0, len(listens))
+	for i, listen := range listens {
+		ln := listen.acceptProxyProtocol(newLimitListener(listeners[i], sem))
+		server := serverConfig.newHTTPServer()
+		switch listen.Protocol {
+		case "http":
+			server.Handler = listen.restrict(&serverConfig, httpHandler)
+		case "https":
+			ln = tls.NewListener(ln, tlsConfig)
+			server.Handler = listen.restrict(&serverConfig, httpsHandler)
+		case "auto":
+			ln = &TLSServerListener{
+				Listener:     ln,
+				TlsConfig:    tlsConfig,
+				SniffTimeout: serverConfig.ReadHeaderTimeout,
+			}
+			server.Handler = listen.restrict(&serverConfig, httpsHandler)
+		}
+		servers = append(servers, server)
 		go func() {
-			if err = http.Serve(&TLSServerListener{
-				Listener:  ln,
-				TlsConfig: tlsConfig,
-			}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-				if r.TLS == nil {
-					u := url.URL{
-						Scheme:   "https",
-						Opaque:   r.URL.Opaque,
-						User:     r.URL.User,
-						Host:     r.Host,
-						Path:     r.URL.Path,
-						RawQuery: r.URL.RawQuery,
-						Fragment: r.URL.Fragment,
-					}
-					// 如果通过http访问，则自动重定向到https
-					http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
-				} else {
-					handler.ServeHTTP(w, r)
-				}
-			})); err != nil {
+			if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
 				log.Panic(err)
 			}
 		}()
 	}
+	trackServers(listeners, servers, serverConfig.ShutdownTimeout)
+	trackCertReloaders(reloaders)
 
 	return
 }
 
+// 慢速客户端最多占用连接 ReadHeaderTimeout，websocket 劫持连接和 SSE 响应会取消读写超时
+func (c *ServerConfig) newHTTPServer() *http.Server {
+	return &http.Server{
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    int(c.MaxHeaderBytes),
+	}
+}
+
+// 返回的 certReloader 需要在服务关闭时停止
+func newTLSConfig(serverConfig *ServerConfig, serverCA *CA, acmeManager *autocert.Manager) (*tls.Config, []*certReloader, error) {
+	// --cert/--key 指定的证书文件会定期检查，更新后自动替换
+	certReloaders := map[string]*certReloader{}
+	var reloaders []*certReloader
+	for _, domain := range append([]DomainConfig{serverConfig.DefaultDomain}, serverConfig.Domains...) {
+		if domain.Cert != "" && domain.Key != "" {
+			reloader := newCertReloader(domain, serverConfig.CertReloadInterval)
+			certReloaders[domain.Domain] = reloader
+			reloaders = append(reloaders, reloader)
+		}
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: func(chi *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			domain := serverConfig.CurrentDomain(chi.ServerName)
+			if acmeManager != nil && domain.ACME && domain.hasName(chi.ServerName) {
+				// ACME 证书由 autocert 缓存和续期
+				return acmeManager.GetCertificate(chi)
+			}
+			if reloader, ok := certReloaders[domain.Domain]; ok {
+				return reloader.getCertificate()
+			}
+			return serverCA.issueCertificate(serverConfig.certificateNames(chi.ServerName))
+		},
+	}
+	// 通过 ALPN 协商 HTTP/2
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	if !serverConfig.DisableHTTP2 {
+		tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	}
+	if acmeManager != nil {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, acme.ALPNProto)
+	}
+	// 设置了 TLS 参数或客户端证书的域名按 SNI 使用各自的配置，其他域名不受影响
+	domainTLSConfigs := map[string]*tls.Config{}
+	for _, domain := range append([]DomainConfig{serverConfig.DefaultDomain}, serverConfig.Domains...) {
+		config, err := domain.tlsConfig(tlsConfig)
+		if err != nil {
+			return nil, reloaders, err
+		}
+		if config != nil {
+			domainTLSConfigs[domain.Domain] = config
+		}
+	}
+	if len(domainTLSConfigs) > 0 {
+		tlsConfig.GetConfigForClient = func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			return domainTLSConfigs[serverConfig.CurrentDomain(chi.ServerName).Domain], nil
+		}
+	}
+	return tlsConfig, reloaders, nil
+}
+
 type Conn struct {
 	net.Conn
 	b byte
-	e error
 	f bool
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
-	if c.f {
+	if c.f && len(b) > 0 {
 		c.f = false
 		b[0] = c.b
-		if len(b) > 1 && c.e == nil {
-			n, e := c.Conn.Read(b[1:])
-			if e != nil {
-				c.Conn.Close()
-			}
-			return n + 1, e
-		} else {
-			return 1, c.e
-		}
+		return 1, nil
 	}
 	return c.Conn.Read(b)
 }
 
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultSniffTimeout      = 10 * time.Second
+)
+
+// 在 https 端口同时处理 https 和 http 请求，每个连接在单独的 goroutine 里读取第一个字节判断协议，
+// 不发送数据的连接不会阻塞其他连接的 Accept
 type TLSServerListener struct {
 	TlsConfig *tls.Config
 	net.Listener
+	SniffTimeout time.Duration
+
+	once      sync.Once
+	closeOnce sync.Once
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+}
+
+func (l *TLSServerListener) init() {
+	l.once.Do(func() {
+		l.conns = make(chan net.Conn)
+		l.errs = make(chan error)
+		l.done = make(chan struct{})
+		go l.acceptLoop()
+	})
 }
 
 func (l *TLSServerListener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
-	if err != nil {
+	l.init()
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
 		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
 	}
+}
 
+func (l *TLSServerListener) Close() error {
+	l.init()
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+func (l *TLSServerListener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.sniff(c)
+	}
+}
+
+func (l *TLSServerListener) sniff(c net.Conn) {
+	timeout := l.SniffTimeout
+	if timeout <= 0 {
+		timeout = defaultSniffTimeout
+	}
 	b := make([]byte, 1)
-	_, err = c.Read(b)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.ReadFull(c, b)
+	c.SetReadDeadline(time.Time{})
 	if err != nil {
+		// 超时或者没有发送数据就断开的连接直接关闭
 		c.Close()
-		if err != io.EOF {
-			return nil, err
-		}
+		return
 	}
 
-	con := &Conn{
+	var con net.Conn = &Conn{
 		Conn: c,
 		b:    b[0],
-		e:    err,
 		f:    true,
 	}
-
 	if b[0] == 22 {
 		// 如果请求是https，则开始使用证书握手
-		return tls.Server(con, l.TlsConfig), nil
+		con = tls.Server(con, l.TlsConfig)
 	}
-
 	// 否则是http请求
-	return con, nil
+	select {
+	case l.conns <- con:
+	case <-l.done:
+		c.Close()
+	}
 }
@@ -0,0 +1,135 @@
+package static
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+	"X25519MLKEM768": tls.X25519MLKEM768,
+}
+
+type tlsPreset struct {
+	minVersion string
+	ciphers    []string
+	curves     []string
+}
+
+// 参考 Mozilla 的 modern 和 intermediate 配置，TLS 1.3 的加密套件不可配置
+var tlsPresets = map[string]tlsPreset{
+	"modern": {
+		minVersion: "1.3",
+		curves:     []string{"X25519", "P-256", "P-384"},
+	},
+	"intermediate": {
+		minVersion: "1.2",
+		ciphers: []string{
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+			"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+			"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+		curves: []string{"X25519", "P-256", "P-384"},
+	},
+}
+
+// 在默认配置的基础上生成域名自己的 tls.Config，没有任何自定义时返回 nil
+func (d *DomainConfig) tlsConfig(base *tls.Config) (*tls.Config, error) {
+	config := base.Clone()
+	custom, err := d.applyTLSOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	clientAuth, err := d.applyClientAuth(config)
+	if err != nil {
+		return nil, err
+	}
+	if !custom && !clientAuth {
+		return nil, nil
+	}
+	return config, nil
+}
+
+// 先应用 preset，再用单独设置的参数覆盖
+func (d *DomainConfig) applyTLSOptions(config *tls.Config) (bool, error) {
+	minVersion, maxVersion, ciphers, curves := d.TLSMinVersion, d.TLSMaxVersion, d.TLSCiphers, d.TLSCurves
+	if d.TLSPreset != "" {
+		preset, ok := tlsPresets[d.TLSPreset]
+		if !ok {
+			return false, fmt.Errorf("%s: invalid tls-preset %s", d.label(), d.TLSPreset)
+		}
+		if minVersion == "" {
+			minVersion = preset.minVersion
+		}
+		if ciphers == nil {
+			ciphers = preset.ciphers
+		}
+		if curves == nil {
+			curves = preset.curves
+		}
+	}
+	if minVersion == "" && maxVersion == "" && ciphers == nil && curves == nil {
+		return false, nil
+	}
+
+	var err error
+	if config.MinVersion, err = parseTLSVersion(minVersion); err != nil {
+		return false, fmt.Errorf("%s: invalid tls-min-version: %w", d.label(), err)
+	}
+	if config.MaxVersion, err = parseTLSVersion(maxVersion); err != nil {
+		return false, fmt.Errorf("%s: invalid tls-max-version: %w", d.label(), err)
+	}
+	if config.MinVersion != 0 && config.MaxVersion != 0 && config.MinVersion > config.MaxVersion {
+		return false, fmt.Errorf("%s: tls-min-version %s is greater than tls-max-version %s", d.label(), minVersion, maxVersion)
+	}
+	for _, name := range ciphers {
+		id, ok := cipherSuiteID(name)
+		if !ok {
+			return false, fmt.Errorf("%s: unknown tls cipher %s", d.label(), name)
+		}
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+	for _, name := range curves {
+		id, ok := tlsCurves[name]
+		if !ok {
+			return false, fmt.Errorf("%s: unknown tls curve %s", d.label(), name)
+		}
+		config.CurvePreferences = append(config.CurvePreferences, id)
+	}
+	return true, nil
+}
+
+// 支持 1.2 和 TLS1.2 两种写法
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[strings.TrimPrefix(strings.ToUpper(version), "TLS")]
+	if !ok {
+		return 0, fmt.Errorf("unknown version %s", version)
+	}
+	return v, nil
+}
+
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+	return 0, false
+}
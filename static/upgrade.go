@@ -0,0 +1,325 @@
+package static
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// 平滑升级时旧进程传给新进程的 socket 数量和旧进程的 pid，
+	// 以及旧进程是否由 systemd 传入 socket 启动
+	envListenFDs       = "MINI_HTTP_LISTEN_FDS"
+	envUpgradePID      = "MINI_HTTP_UPGRADE_PID"
+	envSocketActivated = "MINI_HTTP_SOCKET_ACTIVATED"
+
+	defaultShutdownTimeout = 30 * time.Second
+)
+
+// 当前进程中正在运行的服务，平滑升级时把监听 socket 交给新进程
+var running struct {
+	sync.Mutex
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	servers     []*http.Server
+	h3          []*http3.Server
+	reloaders   []*certReloader
+	timeout     time.Duration
+	upgrading   bool
+}
+
+// 继承的 socket，来自 systemd 的 LISTEN_FDS 或者旧进程，按地址分配给 --listen
+var inherited struct {
+	once        sync.Once
+	systemd     bool
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+}
+
+func loadInherited() {
+	inherited.once.Do(func() {
+		n := 0
+		if pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID")); pid == os.Getpid() {
+			n, _ = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+			inherited.systemd = n > 0
+		} else {
+			n, _ = strconv.Atoi(os.Getenv(envListenFDs))
+			inherited.systemd = n > 0 && os.Getenv(envSocketActivated) == "1"
+		}
+		// 不再传给之后启动的子进程
+		for _, key := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES", envListenFDs, envSocketActivated} {
+			os.Unsetenv(key)
+		}
+		for fd := 3; fd < 3+n; fd++ {
+			file := os.NewFile(uintptr(fd), fmt.Sprintf("inherited-%d", fd))
+			if ln, err := net.FileListener(file); err == nil {
+				inherited.listeners = append(inherited.listeners, ln)
+			} else if conn, err := net.FilePacketConn(file); err == nil {
+				inherited.packetConns = append(inherited.packetConns, conn)
+			} else {
+				log.Printf("inherited fd %d: %v", fd, err)
+			}
+			file.Close()
+		}
+	})
+}
+
+// 是否由 systemd 通过 socket activation 启动
+func socketActivated() bool {
+	loadInherited()
+	return inherited.systemd
+}
+
+// 取出地址相同的继承 socket，没有时返回 nil
+func takeInheritedListener(address string) net.Listener {
+	loadInherited()
+	for i, ln := range inherited.listeners {
+		if sameAddress(address, ln.Addr()) {
+			inherited.listeners = append(inherited.listeners[:i], inherited.listeners[i+1:]...)
+			return ln
+		}
+	}
+	return nil
+}
+
+func takeInheritedPacketConn(address string) net.PacketConn {
+	loadInherited()
+	for i, conn := range inherited.packetConns {
+		if sameAddress(address, conn.LocalAddr()) {
+			inherited.packetConns = append(inherited.packetConns[:i], inherited.packetConns[i+1:]...)
+			return conn
+		}
+	}
+	return nil
+}
+
+// 没有对应 --listen 的继承 socket 按 http 处理
+func takeRemainingInherited() []net.Listener {
+	loadInherited()
+	listeners := inherited.listeners
+	inherited.listeners = nil
+	return listeners
+}
+
+func sameAddress(address string, addr net.Addr) bool {
+	if file, ok := strings.CutPrefix(address, unixPrefix); ok {
+		return addr.Network() == "unix" && addr.String() == file
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		if strconv.Itoa(a.Port) != port {
+			return false
+		}
+		ip = a.IP
+	case *net.UDPAddr:
+		if strconv.Itoa(a.Port) != port {
+			return false
+		}
+		ip = a.IP
+	default:
+		return false
+	}
+	if host == "" {
+		return ip.IsUnspecified()
+	}
+	if addrIP := net.ParseIP(host); addrIP != nil {
+		// systemd 的 ListenStream=8080 监听在 [::]，同时也接受 IPv4
+		return ip.Equal(addrIP) || (ip.IsUnspecified() && addrIP.IsUnspecified())
+	}
+	// localhost 这样的主机名按解析出来的地址比较
+	ips, _ := net.LookupIP(host)
+	for _, addrIP := range ips {
+		if ip.Equal(addrIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func trackServers(listeners []net.Listener, servers []*http.Server, timeout time.Duration) {
+	running.Lock()
+	defer running.Unlock()
+	running.listeners = append(running.listeners, listeners...)
+	running.servers = append(running.servers, servers...)
+	running.timeout = timeout
+}
+
+func trackHTTP3(server *http3.Server, conn net.PacketConn) {
+	running.Lock()
+	defer running.Unlock()
+	running.h3 = append(running.h3, server)
+	running.packetConns = append(running.packetConns, conn)
+}
+
+func trackCertReloaders(reloaders []*certReloader) {
+	running.Lock()
+	defer running.Unlock()
+	running.reloaders = append(running.reloaders, reloaders...)
+}
+
+// 启动新版本的进程并把监听 socket 交给它，新进程启动成功后会通知旧进程退出
+func Upgrade() error {
+	running.Lock()
+	defer running.Unlock()
+	if running.upgrading {
+		return errors.New("upgrade already in progress")
+	}
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+	type filer interface {
+		File() (*os.File, error)
+	}
+	for _, ln := range running.listeners {
+		if unixLn, ok := ln.(*net.UnixListener); ok {
+			// 旧进程退出时不能删除新进程还在使用的 socket 文件
+			unixLn.SetUnlinkOnClose(false)
+		}
+		f, ok := ln.(filer)
+		if !ok {
+			return fmt.Errorf("listener %s can not be passed to the new process", ln.Addr())
+		}
+		file, err := f.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	for _, conn := range running.packetConns {
+		f, ok := conn.(filer)
+		if !ok {
+			return fmt.Errorf("udp %s can not be passed to the new process", conn.LocalAddr())
+		}
+		file, err := f.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envListenFDs, len(files)),
+		fmt.Sprintf("%s=%d", envUpgradePID, os.Getpid()),
+	)
+	if socketActivated() {
+		// 新进程同样不再默认监听 80 端口
+		cmd.Env = append(cmd.Env, envSocketActivated+"=1")
+	}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	running.upgrading = true
+	log.Printf("upgrade: started new process %d", cmd.Process.Pid)
+	go func() {
+		// 新进程启动失败时旧进程继续服务
+		err := cmd.Wait()
+		log.Printf("upgrade: new process %d exited: %v", cmd.Process.Pid, err)
+		running.Lock()
+		running.upgrading = false
+		running.Unlock()
+	}()
+	return nil
+}
+
+// 启动完成后通知 systemd，平滑升级启动的进程还会通知旧进程退出
+func NotifyReady() {
+	state := "READY=1"
+	pid, _ := strconv.Atoi(os.Getenv(envUpgradePID))
+	os.Unsetenv(envUpgradePID)
+	if pid > 0 && pid == os.Getppid() {
+		// 需要 NotifyAccess=all，systemd 才会接受新的主进程
+		state = fmt.Sprintf("MAINPID=%d\n%s", os.Getpid(), state)
+	}
+	if err := sdNotify(state); err != nil {
+		log.Printf("sd_notify: %v", err)
+	}
+	if pid > 0 && pid == os.Getppid() {
+		if process, err := os.FindProcess(pid); err == nil {
+			process.Signal(syscall.SIGTERM)
+		}
+	}
+}
+
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// 停止接受新连接，等待正在处理的请求完成，超过 --shutdown-timeout 后直接关闭
+func Shutdown() error {
+	running.Lock()
+	servers, h3, timeout := running.servers, running.h3, running.timeout
+	reloaders := running.reloaders
+	running.reloaders = nil
+	running.Unlock()
+	for _, reloader := range reloaders {
+		reloader.stop()
+	}
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	sdNotify("STOPPING=1")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(servers)+len(h3))
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- server.Shutdown(ctx)
+		}()
+	}
+	for _, server := range h3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- server.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
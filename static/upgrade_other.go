@@ -0,0 +1,8 @@
+//go:build !unix
+
+package static
+
+import "os"
+
+// 不支持把 socket 传给子进程的系统不提供平滑升级
+var UpgradeSignal os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package static
+
+import (
+	"os"
+	"syscall"
+)
+
+// 收到这个信号时平滑升级
+var UpgradeSignal os.Signal = syscall.SIGUSR2